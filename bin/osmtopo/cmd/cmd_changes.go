@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rubenv/osmtopo/osmtopo"
+)
+
+type CmdChanges struct {
+	global *GlobalOptions
+
+	Since  int64  `short:"s" long:"since" description:"Only show changes after this replication sequence number"`
+	Source string `long:"source" description:"Only show changes of the given source"`
+	IDs    bool   `long:"ids" description:"Print the IDs of all affected relations, one per line"`
+	JSON   bool   `short:"j" long:"json" description:"Output the journal as JSON"`
+}
+
+func init() {
+	_, err := parser.AddCommand("changes",
+		"Show changed relations",
+		"Show the relations affected by each applied replication change\n\nOpens the data store read-only, so it can be used while the server is running.",
+		&CmdChanges{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cmd CmdChanges) Usage() string {
+	return ""
+}
+
+func (cmd CmdChanges) Execute(args []string) error {
+	env, err := cmd.global.OpenEnvReadOnly()
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+
+	changes, err := env.GetChanges(cmd.Source, cmd.Since)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case cmd.JSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	case cmd.IDs:
+		for _, id := range affectedRelations(changes) {
+			fmt.Println(id)
+		}
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "Source\tSequence\tTime\tRelations")
+		for _, change := range changes {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%v\n", change.Source, change.Sequence, change.Time.Format(time.RFC3339), change.Relations)
+		}
+		w.Flush()
+	}
+
+	return nil
+}
+
+// Returns the sorted, unique IDs of all relations affected by the changes
+func affectedRelations(changes []*osmtopo.ChangeEntry) []int64 {
+	seen := make(map[int64]bool)
+	result := make([]int64, 0)
+	for _, change := range changes {
+		for _, id := range change.Relations {
+			if !seen[id] {
+				seen[id] = true
+				result = append(result, id)
+			}
+		}
+	}
+	sort.Sort(osmtopo.IDSlice(result))
+	return result
+}
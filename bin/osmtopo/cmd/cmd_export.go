@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rubenv/osmtopo/osmtopo"
+)
+
+type CmdExport struct {
+	global *GlobalOptions
+
+	SkipUpdate  bool `long:"skip-update" description:"Export the data currently in the store, without updating sources first"`
+	Incremental bool `short:"i" long:"incremental" description:"Only rewrite slices that contain relations which changed since the previous export"`
+}
+
+func init() {
+	_, err := parser.AddCommand("export",
+		"Export topologies",
+		"Export topologies to the output folder\n\nWaits until all sources are up to date, exports all layers and exits. Fails when updating the sources or exporting any of the layers fails.",
+		&CmdExport{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cmd CmdExport) Usage() string {
+	return ""
+}
+
+func (cmd CmdExport) Execute(args []string) error {
+	var env *osmtopo.Env
+	var err error
+	if cmd.SkipUpdate {
+		env, err = cmd.global.OpenEnv()
+	} else {
+		env, err = cmd.global.NewEnv()
+	}
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+	stopOnSignal(env)
+
+	err = env.WaitFirstUpdate()
+	if err != nil {
+		return fmt.Errorf("Failed to update sources: %s", err)
+	}
+
+	var layers []*osmtopo.LayerExportStatus
+	if cmd.Incremental {
+		layers, err = env.ExportIncremental()
+	} else {
+		layers, err = env.Export()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Layer\tFeatures\tSlices\tChanged\tPoints\t")
+	for _, layer := range layers {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t", layer.ID, layer.Features, layer.Slices, layer.Changed, layer.Points)
+		if layer.Error != "" {
+			fmt.Fprintf(w, " Failed: %s", layer.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	return err
+}
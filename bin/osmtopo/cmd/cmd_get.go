@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/omniscale/imposm3/element"
+	"github.com/rubenv/osmtopo/osmtopo"
+	"github.com/rubenv/osmtopo/osmtopo/model"
+)
+
+type CmdGet struct {
+	global *GlobalOptions
+
+	Recursive bool `short:"r" long:"recursive" description:"Include referenced ways and nodes"`
+	Cached    bool `long:"cached" description:"Show the cached geometry, rather than building it from the relation"`
+}
+
+type wayInfo struct {
+	*model.Way
+	Nodes   []*model.Node `json:"nodes,omitempty"`
+	Missing []int64       `json:"missing,omitempty"`
+}
+
+type relationInfo struct {
+	*model.Relation
+	Ways    []*wayInfo `json:"ways,omitempty"`
+	Missing []int64    `json:"missing,omitempty"`
+}
+
+func init() {
+	_, err := parser.AddCommand("get",
+		"Get items",
+		"Get items from datastore\n\nOpens the data store read-only, so it can be used while the server is running.",
+		&CmdGet{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cmd CmdGet) Usage() string {
+	return "[node|way|relation|geometry|coverage] id"
+}
+
+func (cmd CmdGet) Execute(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Options missing, Usage: %s", cmd.Usage())
+	}
+
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	env, err := cmd.global.OpenEnvReadOnly()
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+
+	var out interface{}
+	switch args[0] {
+	case "node":
+		node, err := env.GetNode(id)
+		if err != nil {
+			return fmt.Errorf("Failed to get node: %s\n", err.Error())
+		}
+		if node == nil {
+			return fmt.Errorf("Node %d not found", id)
+		}
+		out = node
+	case "way":
+		way, err := env.GetWay(id)
+		if err != nil {
+			return fmt.Errorf("Failed to get way: %s\n", err.Error())
+		}
+		if way == nil {
+			return fmt.Errorf("Way %d not found", id)
+		}
+		out, err = cmd.wayInfo(env, way)
+		if err != nil {
+			return err
+		}
+	case "relation":
+		rel, err := env.GetRelation(id)
+		if err != nil {
+			return fmt.Errorf("Failed to get relation: %s\n", err.Error())
+		}
+		if rel == nil {
+			return fmt.Errorf("Relation %d not found", id)
+		}
+		out, err = cmd.relationInfo(env, rel)
+		if err != nil {
+			return err
+		}
+	case "geometry":
+		if cmd.Cached {
+			geom, err := env.GetGeometry("rel", id)
+			if err != nil {
+				return fmt.Errorf("Failed to get geometry: %s\n", err.Error())
+			}
+			if geom == nil {
+				return fmt.Errorf("No cached geometry for relation %d", id)
+			}
+			out = json.RawMessage(geom.Geojson)
+			break
+		}
+
+		rel, err := env.GetRelation(id)
+		if err != nil {
+			return fmt.Errorf("Failed to get relation: %s\n", err.Error())
+		}
+		if rel == nil {
+			return fmt.Errorf("Relation %d not found", id)
+		}
+
+		geom, err := osmtopo.ToGeometry(rel, env)
+		if err != nil {
+			return fmt.Errorf("Failed to convert to geometry: %s on relation %d", err, id)
+		}
+
+		geom, err = geom.Buffer(0)
+		if err != nil {
+			return fmt.Errorf("Buffer failed: %s on relation %d", err, id)
+		}
+
+		out, err = osmtopo.GeometryFromGeos(geom)
+		if err != nil {
+			return err
+		}
+	case "coverage":
+		cov, err := env.GetS2Coverage(id)
+		if err != nil {
+			return fmt.Errorf("Failed to get coverage: %s\n", err.Error())
+		}
+		if cov == nil {
+			return fmt.Errorf("No coverage for relation %d", id)
+		}
+		out = cov
+	default:
+		return fmt.Errorf("Unknown type %s, Usage: %s", args[0], cmd.Usage())
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	return enc.Encode(out)
+}
+
+func (cmd CmdGet) wayInfo(env *osmtopo.Env, way *model.Way) (*wayInfo, error) {
+	info := &wayInfo{
+		Way: way,
+	}
+	if !cmd.Recursive {
+		return info, nil
+	}
+
+	for _, ref := range way.Refs {
+		node, err := env.GetNode(ref)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			info.Missing = append(info.Missing, ref)
+			continue
+		}
+		info.Nodes = append(info.Nodes, node)
+	}
+	return info, nil
+}
+
+func (cmd CmdGet) relationInfo(env *osmtopo.Env, rel *model.Relation) (*relationInfo, error) {
+	info := &relationInfo{
+		Relation: rel,
+	}
+	if !cmd.Recursive {
+		return info, nil
+	}
+
+	for _, m := range rel.Members {
+		if m.Type != int32(element.WAY) {
+			continue
+		}
+
+		way, err := env.GetWay(m.Id)
+		if err != nil {
+			return nil, err
+		}
+		if way == nil {
+			info.Missing = append(info.Missing, m.Id)
+			continue
+		}
+
+		w, err := cmd.wayInfo(env, way)
+		if err != nil {
+			return nil, err
+		}
+		info.Ways = append(info.Ways, w)
+	}
+	return info, nil
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type CmdImport struct {
+	global *GlobalOptions
+
+	Name string `short:"n" long:"name" description:"Source name to import as (defaults to the file name, e.g. belgium for belgium-latest.osm.pbf)"`
+	Mode string `short:"m" long:"mode" choice:"multi-pass" choice:"single-pass" description:"Import mode (defaults to the import_mode of the source, or multi-pass): single-pass parses the file once, but needs temporary disk space for all ways and nodes"`
+}
+
+func init() {
+	_, err := parser.AddCommand("import",
+		"Import PBF files",
+		"Import one or more local PBF files into the data store\n\nThe source name determines where replication continues from, make it match the name in the config file.",
+		&CmdImport{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cmd CmdImport) Usage() string {
+	return "file.osm.pbf [file.osm.pbf...]"
+}
+
+func (cmd CmdImport) Execute(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("No files specified, Usage: %s", cmd.Usage())
+	}
+	if cmd.Name != "" && len(args) > 1 {
+		return fmt.Errorf("Cannot use --name when importing multiple files")
+	}
+
+	env, err := cmd.global.OpenEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+	stopOnSignal(env)
+
+	for _, filename := range args {
+		name := cmd.Name
+		if name == "" {
+			name = sourceName(filename)
+		}
+
+		var err error
+		if cmd.Mode != "" {
+			err = env.ImportFileMode(name, filename, cmd.Mode)
+		} else {
+			err = env.ImportFile(name, filename)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to import %s: %s", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// Derives a source name from a file name: belgium-latest.osm.pbf becomes belgium
+func sourceName(filename string) string {
+	name := path.Base(filename)
+	for _, suffix := range []string{".pbf", ".osm", "-latest"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
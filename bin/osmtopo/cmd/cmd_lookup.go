@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/rubenv/osmtopo/osmtopo"
+)
+
+type CmdLookup struct {
+	global *GlobalOptions
+
+	All    bool     `short:"a" long:"all" description:"Match against all relations in the store, rather than the selected topologies"`
+	Layers []string `short:"l" long:"layer" description:"Only look up in this layer (can be repeated)"`
+	Format string   `short:"f" long:"format" description:"Input format, derived from the file name when not set" choice:"text" choice:"csv" choice:"geojson"`
+}
+
+func init() {
+	_, err := parser.AddCommand("lookup",
+		"Look up points",
+		"Look up the relations that contain points\n\nReads points from a file (or stdin) and outputs the matching relations of each layer:\n\n  text:    lines of \"lat lon\" or \"lat,lon\", outputs a line of JSON per point\n  csv:     needs lat and lon columns, outputs the same CSV with <layer>_id and <layer>_name columns\n  geojson: a collection of point features, outputs the same collection with a property per layer",
+		&CmdLookup{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cmd CmdLookup) Usage() string {
+	return "[file]"
+}
+
+func (cmd CmdLookup) Execute(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Too many arguments, Usage: %s", cmd.Usage())
+	}
+
+	in := io.Reader(os.Stdin)
+	format := cmd.Format
+	if len(args) == 1 {
+		fp, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		in = fp
+
+		if format == "" {
+			switch strings.ToLower(path.Ext(args[0])) {
+			case ".csv":
+				format = "csv"
+			case ".json", ".geojson":
+				format = "geojson"
+			}
+		}
+	}
+
+	env, err := cmd.global.OpenEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+	stopOnSignal(env)
+
+	if cmd.All {
+		err = env.LoadLookup()
+	} else {
+		err = env.LoadTopologies()
+	}
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "csv":
+		return cmd.lookupCSV(env, in, os.Stdout)
+	case "geojson":
+		return cmd.lookupGeoJSON(env, in, os.Stdout)
+	default:
+		return cmd.lookupText(env, in, os.Stdout)
+	}
+}
+
+func (cmd CmdLookup) lookupText(env *osmtopo.Env, in io.Reader, out io.Writer) error {
+	enc := json.NewEncoder(out)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 {
+			return fmt.Errorf("Expected \"lat lon\", got: %s", line)
+		}
+
+		lat, lon, err := parseLatLon(fields[0], fields[1])
+		if err != nil {
+			return err
+		}
+
+		result, err := env.Lookup(lat, lon, cmd.Layers, cmd.All)
+		if err != nil {
+			return err
+		}
+
+		err = enc.Encode(result)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (cmd CmdLookup) lookupCSV(env *osmtopo.Env, in io.Reader, out io.Writer) error {
+	r := csv.NewReader(in)
+	w := csv.NewWriter(out)
+	defer w.Flush()
+
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+
+	latCol := -1
+	lonCol := -1
+	for i, col := range header {
+		switch strings.ToLower(strings.TrimSpace(col)) {
+		case "lat", "latitude":
+			latCol = i
+		case "lon", "lng", "long", "longitude":
+			lonCol = i
+		}
+	}
+	if latCol < 0 || lonCol < 0 {
+		return fmt.Errorf("CSV file should have lat and lon columns")
+	}
+
+	layers := cmd.layers(env)
+	for _, layer := range layers {
+		header = append(header, fmt.Sprintf("%s_id", layer), fmt.Sprintf("%s_name", layer))
+	}
+	err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		lat, lon, err := parseLatLon(record[latCol], record[lonCol])
+		if err != nil {
+			return err
+		}
+
+		result, err := env.Lookup(lat, lon, layers, cmd.All)
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range layers {
+			ids := []string{}
+			names := []string{}
+			for _, m := range result.Layers[layer] {
+				ids = append(ids, fmt.Sprintf("%d", m.ID))
+				names = append(names, m.Name)
+			}
+			record = append(record, strings.Join(ids, ";"), strings.Join(names, ";"))
+		}
+
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Error()
+}
+
+func (cmd CmdLookup) lookupGeoJSON(env *osmtopo.Env, in io.Reader, out io.Writer) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fc.Features {
+		if f.Geometry == nil || f.Geometry.Type != geojson.GeometryPoint {
+			continue
+		}
+
+		lat := f.Geometry.Point[1]
+		lon := f.Geometry.Point[0]
+		result, err := env.Lookup(lat, lon, cmd.Layers, cmd.All)
+		if err != nil {
+			return err
+		}
+
+		for layer, matches := range result.Layers {
+			f.SetProperty(layer, matches)
+		}
+	}
+
+	return json.NewEncoder(out).Encode(fc)
+}
+
+// Layers to output, in config order
+func (cmd CmdLookup) layers(env *osmtopo.Env) []string {
+	if len(cmd.Layers) > 0 {
+		return cmd.Layers
+	}
+
+	result := []string{}
+	for _, layer := range env.Status.Config.Layers {
+		result = append(result, layer.ID)
+	}
+	return result
+}
+
+func parseLatLon(latStr, lonStr string) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid latitude: %s", latStr)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid longitude: %s", lonStr)
+	}
+	return lat, lon, nil
+}
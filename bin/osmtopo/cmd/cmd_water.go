@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+)
+
+type CmdWater struct {
+	global *GlobalOptions
+}
+
+func init() {
+	_, err := parser.AddCommand("water",
+		"Manage water polygons",
+		"Download and import water polygons\n\nImport without a filename to fetch the polygons from the configured location.",
+		&CmdWater{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cmd CmdWater) Usage() string {
+	return "[download filename|import [filename]]"
+}
+
+func (cmd CmdWater) Execute(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Options missing, Usage: %s", cmd.Usage())
+	}
+
+	filename := ""
+	switch args[0] {
+	case "download":
+		if len(args) != 2 {
+			return fmt.Errorf("Filename missing, Usage: %s", cmd.Usage())
+		}
+		filename = args[1]
+	case "import":
+		if len(args) > 2 {
+			return fmt.Errorf("Too many arguments, Usage: %s", cmd.Usage())
+		}
+		if len(args) == 2 {
+			filename = args[1]
+		}
+	default:
+		return fmt.Errorf("Unknown action %s, Usage: %s", args[0], cmd.Usage())
+	}
+
+	env, err := cmd.global.OpenEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+	stopOnSignal(env)
+
+	if args[0] == "download" {
+		return env.DownloadWater(filename)
+	}
+	return env.ImportWater(filename)
+}
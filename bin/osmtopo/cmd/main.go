@@ -3,6 +3,8 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/rubenv/osmtopo/osmtopo"
@@ -39,3 +41,43 @@ func (g *GlobalOptions) NewEnv() (*osmtopo.Env, error) {
 	}
 	return env, nil
 }
+
+// Opens the environment without starting the background updater
+func (g *GlobalOptions) OpenEnv() (*osmtopo.Env, error) {
+	config, err := osmtopo.ReadConfig(g.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := osmtopo.OpenEnv(config, g.Topologies, g.DataStore, g.OutputPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open env: %s\n", err.Error())
+	}
+	return env, nil
+}
+
+// Stops the env (cancelling any running work) when interrupted
+func stopOnSignal(env *osmtopo.Env) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+	signal.Notify(stop, syscall.SIGINT)
+
+	go func() {
+		<-stop
+		env.Stop()
+	}()
+}
+
+// Opens the environment with a read-only data store
+func (g *GlobalOptions) OpenEnvReadOnly() (*osmtopo.Env, error) {
+	config, err := osmtopo.ReadConfig(g.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := osmtopo.OpenEnvReadOnly(config, g.Topologies, g.DataStore, g.OutputPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open env: %s\n", err.Error())
+	}
+	return env, nil
+}
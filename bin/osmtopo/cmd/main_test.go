@@ -1 +1,41 @@
 package cmd
+
+import (
+	"testing"
+
+	"github.com/cheekybits/is"
+	"github.com/rubenv/osmtopo/osmtopo"
+)
+
+func TestSourceName(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(sourceName("belgium-latest.osm.pbf"), "belgium")
+	is.Equal(sourceName("/data/netherlands-latest.osm.pbf"), "netherlands")
+	is.Equal(sourceName("isle-of-man.osm.pbf"), "isle-of-man")
+	is.Equal(sourceName("andorra.pbf"), "andorra")
+}
+
+func TestParseLatLon(t *testing.T) {
+	is := is.New(t)
+
+	lat, lon, err := parseLatLon("42.5716281", " 1.5209959")
+	is.NoErr(err)
+	is.Equal(lat, 42.5716281)
+	is.Equal(lon, 1.5209959)
+
+	_, _, err = parseLatLon("north", "1.5")
+	is.Err(err)
+}
+
+func TestAffectedRelations(t *testing.T) {
+	is := is.New(t)
+
+	changes := []*osmtopo.ChangeEntry{
+		{Source: "benelux", Sequence: 1, Relations: []int64{3, 1}},
+		{Source: "benelux", Sequence: 2, Relations: []int64{}},
+		{Source: "benelux", Sequence: 3, Relations: []int64{2, 3}},
+	}
+	is.Equal(affectedRelations(changes), []int64{1, 2, 3})
+	is.Equal(affectedRelations(nil), []int64{})
+}
@@ -8,7 +8,7 @@ import {
     FormGroup, Label, Input, Button, Alert
 } from "reactstrap";
 
-import Store, { ExportStatus, Layer, Suggestion } from "./store";
+import Store, { ExportStatus, Layer, Progress, Suggestion } from "./store";
 
 import MapContainer from "./MapContainer";
 
@@ -26,6 +26,7 @@ class App extends React.Component<AppProperties, any> {
                     <Col className="text-center">
                         <h1>Initializing...</h1>
                         { store.updating && <p>Geometry data is being updated.</p> }
+                        { store.progress && this.renderProgress(store.progress) }
                     </Col>
                 </Row>
             </Container>;
@@ -132,6 +133,29 @@ class App extends React.Component<AppProperties, any> {
         );
     }
 
+    private renderProgress(p: Progress) {
+        const eta = p.eta ? new Date(p.eta).toLocaleTimeString() : "";
+        if (p.task == "replicate") {
+            return (
+                <div className="progress-status">
+                    <p>Replicating {p.source}: change {p.sequence} of {p.from_sequence} &rarr; {p.to_sequence}</p>
+                    { eta && <p>Expected to finish at {eta}</p> }
+                </div>
+            );
+        }
+        return (
+            <div className="progress-status">
+                <p>Importing {p.source}, {p.phase} pass</p>
+                <p>
+                    Nodes: {p.nodes} ({p.node_rate}/s),
+                    ways: {p.ways} ({p.way_rate}/s),
+                    relations: {p.relations} ({p.relation_rate}/s)
+                </p>
+                { eta && <p>Expected to finish this pass at {eta}</p> }
+            </div>
+        );
+    }
+
     private hoverSuggestion = (layer: Layer, suggestion: Suggestion) => () => {
         this.props.store.hoverFeature(layer.id, suggestion.id);
     }
@@ -6,6 +6,7 @@ interface Status {
     initialized: boolean;
     missing: number;
     config: Config;
+    progress?: Progress;
 }
 
 export interface ExportStatus {
@@ -13,6 +14,23 @@ export interface ExportStatus {
     error: string;
 }
 
+export interface Progress {
+    source: string;
+    task: string;
+    phase: string;
+    started: string;
+    nodes: number;
+    ways: number;
+    relations: number;
+    node_rate: number;
+    way_rate: number;
+    relation_rate: number;
+    from_sequence?: number;
+    sequence?: number;
+    to_sequence?: number;
+    eta?: string;
+}
+
 export interface MissingCoordinate {
     coordinate: Coordinate;
     suggestions: { [key: string]: Array<Suggestion> };
@@ -60,6 +78,7 @@ class Store {
     @observable public initialized: boolean = false;
     @observable public missing: number = 0;
     @observable public loading: boolean = false;
+    @observable public progress?: Progress;
 
     @observable public coordinate?: MissingCoordinate;
     @observable public config: Config;
@@ -73,8 +92,12 @@ class Store {
     @observable public selected: { [key: string]: number } = {};
 
     public startPoll() {
-        this.pollStatus();
-        setInterval(() => this.pollStatus(), 1000);
+        if (typeof EventSource !== "undefined") {
+            this.listenEvents();
+        } else {
+            this.pollStatus();
+            setInterval(() => this.pollStatus(), 1000);
+        }
         autorun(() => {
             if (this.initialized && this.missing > 0 && !this.coordinate) {
                 this.loadCoordinate();
@@ -140,6 +163,51 @@ class Store {
         this.updateStatus(result);
     }
 
+    // The server pushes status changes, reconnecting gets a fresh status
+    private listenEvents() {
+        const events = new EventSource("/api/events");
+        const on = (type: string, fn: (data: any) => void) => {
+            events.addEventListener(type, (e: MessageEvent) => {
+                fn(JSON.parse(e.data));
+            });
+        };
+
+        on("status", (status: Status) => this.updateStatus(status));
+        on("updater.started", () => this.setUpdating(true));
+        on("updater.finished", () => this.setUpdating(false));
+        on("initialized", () => this.setInitialized());
+        on("export.started", (e: ExportStatus) => this.setExport(e));
+        on("export.finished", (e: ExportStatus) => this.setExport(e));
+        on("export.failed", (e: ExportStatus) => this.setExport(e));
+        on("missing", (e: { missing: number }) => this.setMissing(e.missing));
+        on("progress", (p: Progress | null) => this.setProgress(p));
+    }
+
+    @action
+    private setUpdating(updating: boolean) {
+        this.updating = updating;
+    }
+
+    @action
+    private setInitialized() {
+        this.initialized = true;
+    }
+
+    @action
+    private setExport(e: ExportStatus) {
+        this.export = e;
+    }
+
+    @action
+    private setMissing(missing: number) {
+        this.missing = missing;
+    }
+
+    @action
+    private setProgress(p: Progress | null) {
+        this.progress = p || undefined;
+    }
+
     @action
     private updateStatus(status: Status) {
         this.updating = status.running;
@@ -147,6 +215,7 @@ class Store {
         this.initialized = status.initialized;
         this.missing = status.missing || 0;
         this.config = status.config;
+        this.progress = status.progress || undefined;
     }
 
     @action
@@ -0,0 +1,139 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// Relations affected by a single replication change file
+type ChangeEntry struct {
+	Source    string    `json:"source"`
+	Sequence  int64     `json:"sequence"`
+	Time      time.Time `json:"time"`
+	Relations []int64   `json:"relations"`
+}
+
+func changeKey(source string, seq int64) []byte {
+	return []byte(fmt.Sprintf("changes/%s/%012d", source, seq))
+}
+
+// Records a change, dropping the entries of its source that are older than
+// the configured retention
+func (e *Env) addChange(change *ChangeEntry) error {
+	sort.Sort(IDSlice(change.Relations))
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	wb.Put(changeKey(change.Source, change.Sequence), data)
+
+	if e.config.KeepChanges > 0 {
+		cutoff := change.Time.Add(-time.Duration(e.config.KeepChanges) * time.Second)
+		err = e.expireChanges(wb, change.Source, cutoff)
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.db.Write(e.wo, wb)
+}
+
+// Deletes the changes of a source that were recorded before the cutoff.
+// Entries are in sequence order, so this stops at the first newer one.
+func (e *Env) expireChanges(wb *gorocksdb.WriteBatch, source string, cutoff time.Time) error {
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+
+	it := e.db.NewIterator(ro)
+	defer it.Close()
+
+	prefix := []byte(fmt.Sprintf("changes/%s/", source))
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Key()
+		k := append([]byte(nil), key.Data()...)
+		key.Free()
+		_, err := strconv.ParseInt(strings.TrimPrefix(string(k), string(prefix)), 10, 64)
+		if err != nil {
+			// Not a change entry
+			continue
+		}
+
+		value := it.Value()
+		change := &ChangeEntry{}
+		err = json.Unmarshal(value.Data(), change)
+		value.Free()
+		if err != nil {
+			return err
+		}
+		if !change.Time.Before(cutoff) {
+			break
+		}
+		wb.Delete(k)
+	}
+	return it.Err()
+}
+
+// Returns the journal of changes applied after the given sequence number,
+// ordered by source and sequence. An empty source returns the changes of all
+// sources.
+func (e *Env) GetChanges(source string, since int64) ([]*ChangeEntry, error) {
+	sources := make([]string, 0, len(e.config.Sources))
+	if source != "" {
+		if _, ok := e.config.Sources[source]; !ok {
+			return nil, fmt.Errorf("Unknown source: %s", source)
+		}
+		sources = append(sources, source)
+	} else {
+		for name := range e.config.Sources {
+			sources = append(sources, name)
+		}
+		sort.Strings(sources)
+	}
+
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+
+	it := e.db.NewIterator(ro)
+	defer it.Close()
+
+	result := make([]*ChangeEntry, 0)
+	for _, name := range sources {
+		prefix := []byte(fmt.Sprintf("changes/%s/", name))
+		for it.Seek(changeKey(name, since+1)); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Key()
+			_, err := strconv.ParseInt(strings.TrimPrefix(string(key.Data()), string(prefix)), 10, 64)
+			key.Free()
+			if err != nil {
+				// Not a change entry (e.g. a source name that has
+				// this source as a prefix)
+				continue
+			}
+
+			value := it.Value()
+			change := &ChangeEntry{}
+			err = json.Unmarshal(value.Data(), change)
+			value.Free()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, change)
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
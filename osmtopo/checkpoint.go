@@ -0,0 +1,240 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/rubenv/osmtopo/osmtopo/needidx"
+	"github.com/tecbot/gorocksdb"
+)
+
+// Import passes, in order
+const (
+	passRelations = iota + 1
+	passWays
+	passNodes
+)
+
+var passNames = map[int]string{
+	passRelations: "relations",
+	passWays:      "ways",
+	passNodes:     "nodes",
+}
+
+// Progress of an import, stored after each completed pass so an interrupted
+// import can resume. The need indexes are stored next to it.
+type importCheckpoint struct {
+	// Identifies the PBF file, which may have been downloaded again
+	Size     int64     `json:"size"`
+	Sequence int64     `json:"sequence"`
+	Time     time.Time `json:"time"`
+
+	// Import mode, a single-pass import also keeps its spooled data
+	Mode string `json:"mode"`
+
+	// Clipped imports spool everything until the last pass is done
+	Clip bool `json:"clip"`
+
+	// Last completed pass
+	Pass int `json:"pass"`
+
+	Nodes     int64 `json:"nodes"`
+	Ways      int64 `json:"ways"`
+	Relations int64 `json:"relations"`
+}
+
+func (c *importCheckpoint) matches(other *importCheckpoint) bool {
+	return c.Size == other.Size && c.Sequence == other.Sequence && c.Time.Equal(other.Time) && c.Mode == other.Mode && c.Clip == other.Clip
+}
+
+// Folder with the checkpoint of an import
+func (i *importer) checkpointFolder() string {
+	return path.Join(i.env.storePath, "import", i.name)
+}
+
+// Loads the checkpoint of an earlier, interrupted import of the same file.
+// Returns nil when there's nothing to resume.
+func (i *importer) loadCheckpoint(current *importCheckpoint) (*importCheckpoint, error) {
+	folder := i.checkpointFolder()
+	data, err := ioutil.ReadFile(path.Join(folder, "checkpoint.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &importCheckpoint{}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cp.matches(current) {
+		i.log("Discarding checkpoint of a different file or import mode")
+		return nil, i.removeCheckpoint()
+	}
+
+	indexes := map[string]*needidx.NeedIdx{}
+	switch cp.Pass {
+	case passRelations:
+		indexes["ways.idx"] = i.waysNeeded
+	case passWays:
+		indexes["nodes.idx"] = i.nodesNeeded
+	}
+	for filename, idx := range indexes {
+		err := readNeedIdx(path.Join(folder, filename), idx)
+		if err != nil {
+			i.log("Discarding checkpoint: %s", err)
+			i.waysNeeded = needidx.New()
+			i.nodesNeeded = needidx.New()
+			return nil, i.removeCheckpoint()
+		}
+	}
+
+	i.nodeCount.Store(cp.Nodes)
+	i.wayCount.Store(cp.Ways)
+	i.relationCount.Store(cp.Relations)
+	return cp, nil
+}
+
+// Records that a pass has completed, along with the need index the next pass
+// depends on
+func (i *importer) saveCheckpoint(cp *importCheckpoint, pass int) error {
+	folder := i.checkpointFolder()
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Writes go through the WAL without syncing, the checkpoint may only
+	// claim a pass once everything it stored is on disk
+	err = i.flush()
+	if err != nil {
+		return err
+	}
+
+	indexes := map[string]*needidx.NeedIdx{}
+	switch pass {
+	case passRelations:
+		indexes["ways.idx"] = i.waysNeeded
+	case passWays:
+		indexes["nodes.idx"] = i.nodesNeeded
+	}
+	for filename, idx := range indexes {
+		err := writeNeedIdx(path.Join(folder, filename), idx)
+		if err != nil {
+			return err
+		}
+	}
+
+	cp.Pass = pass
+	cp.Nodes = i.nodeCount.Load()
+	cp.Ways = i.wayCount.Load()
+	cp.Relations = i.relationCount.Load()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	// Written last, so it never refers to incomplete indexes
+	err = writeSynced(path.Join(folder, "checkpoint.json"), func(fp *os.File) error {
+		_, err := fp.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = syncFolder(folder)
+	if err != nil {
+		return err
+	}
+
+	// Indexes of earlier passes are no longer needed
+	if pass == passWays {
+		err = os.Remove(path.Join(folder, "ways.idx"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *importer) removeCheckpoint() error {
+	return os.RemoveAll(i.checkpointFolder())
+}
+
+// Flushes the store and the spool, if any
+func (i *importer) flush() error {
+	fo := gorocksdb.NewDefaultFlushOptions()
+	defer fo.Destroy()
+	fo.SetWait(true)
+
+	err := i.env.db.Flush(fo)
+	if err != nil {
+		return err
+	}
+	if i.spool != nil {
+		return i.spool.Flush(fo)
+	}
+	return nil
+}
+
+func writeNeedIdx(filename string, idx *needidx.NeedIdx) error {
+	return writeSynced(filename, func(fp *os.File) error {
+		_, err := idx.WriteTo(fp)
+		return err
+	})
+}
+
+// Writes a file through a temporary one, which is synced before it replaces
+// the original
+func writeSynced(filename string, write func(fp *os.File) error) error {
+	tmp := filename + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = write(fp)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	err = fp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Makes renames within a folder durable
+func syncFolder(folder string) error {
+	fp, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
+func readNeedIdx(filename string, idx *needidx.NeedIdx) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = idx.ReadFrom(fp)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/omniscale/imposm3/element"
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/rubenv/osmtopo/osmtopo/model"
+)
+
+// Area of interest of a source: relations that lie entirely outside of it
+// are not stored.
+type clipArea struct {
+	Bounds   boundingBox
+	Geometry *geos.Geometry
+	Prepared *geos.PGeometry
+
+	// Whether the area is just the bounding box
+	IsBox bool
+}
+
+// Loads the clip area of a source, nil if it has none
+func loadClipArea(source PBFSource) (*clipArea, error) {
+	if len(source.Clip) > 0 && source.ClipFile != "" {
+		return nil, fmt.Errorf("Only one of clip and clip_file can be set")
+	}
+
+	if len(source.Clip) > 0 {
+		b := source.Clip
+		if len(b) != 4 || b[0] >= b[2] || b[1] >= b[3] {
+			return nil, fmt.Errorf("Invalid clip bounds, expected [min lon, min lat, max lon, max lat]: %v", b)
+		}
+
+		ring := [][]float64{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}, {b[0], b[1]}}
+		geom, err := GeometryToGeos(geojson.NewPolygonGeometry([][][]float64{ring}))
+		if err != nil {
+			return nil, err
+		}
+		return newClipArea(geom, true)
+	}
+
+	if source.ClipFile != "" {
+		geom, err := readClipFile(source.ClipFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %s", source.ClipFile, err)
+		}
+		return newClipArea(geom, false)
+	}
+
+	return nil, nil
+}
+
+func newClipArea(geom *geos.Geometry, isBox bool) (*clipArea, error) {
+	env, err := geom.Envelope()
+	if err != nil {
+		return nil, err
+	}
+	shell, err := env.Shell()
+	if err != nil {
+		return nil, err
+	}
+	coords, err := shell.Coords()
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := newBoundingBox()
+	for _, c := range coords {
+		bounds.bound([]float64{c.X, c.Y})
+	}
+
+	return &clipArea{
+		Bounds:   bounds,
+		Geometry: geom,
+		Prepared: geom.Prepare(),
+		IsBox:    isBox,
+	}, nil
+}
+
+// Reads the (multi)polygons of a GeoJSON file: a feature collection, a
+// feature or a bare geometry
+func readClipFile(filename string) (*geos.Geometry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj struct {
+		Type string `json:"type"`
+	}
+	err = json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	geometries := make([]*geojson.Geometry, 0)
+	switch obj.Type {
+	case "FeatureCollection":
+		fc, err := geojson.UnmarshalFeatureCollection(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fc.Features {
+			geometries = append(geometries, f.Geometry)
+		}
+	case "Feature":
+		f, err := geojson.UnmarshalFeature(data)
+		if err != nil {
+			return nil, err
+		}
+		geometries = append(geometries, f.Geometry)
+	default:
+		g, err := geojson.UnmarshalGeometry(data)
+		if err != nil {
+			return nil, err
+		}
+		geometries = append(geometries, g)
+	}
+
+	polygons := make([]*geos.Geometry, 0)
+	for _, g := range geometries {
+		if g == nil || (!g.IsPolygon() && !g.IsMultiPolygon()) {
+			continue
+		}
+
+		geom, err := GeometryToGeos(g)
+		if err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, geom)
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("No polygons found")
+	}
+
+	geom, err := geos.NewCollection(geos.GEOMETRYCOLLECTION, polygons...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merges overlapping polygons
+	return geom.Buffer(0)
+}
+
+// Checks whether a relation lies entirely outside of the clip area, using the
+// ways and nodes of the given source. Relations of which the geometry can't be
+// determined are kept.
+func outsideClipArea(clip *clipArea, rel *model.Relation, src elementSource) (bool, error) {
+	bounds := newBoundingBox()
+	inside := false
+	for _, m := range rel.GetMembers() {
+		if m.Type != int32(element.WAY) {
+			continue
+		}
+
+		way, err := src.GetWay(m.Id)
+		if err != nil {
+			return false, err
+		}
+		if way == nil {
+			continue
+		}
+
+		for _, ref := range way.Refs {
+			node, err := src.GetNode(ref)
+			if err != nil {
+				return false, err
+			}
+			if node == nil {
+				continue
+			}
+
+			bounds.bound([]float64{node.Lon, node.Lat})
+			if clip.IsBox && node.Lon >= clip.Bounds[0] && node.Lon <= clip.Bounds[2] && node.Lat >= clip.Bounds[1] && node.Lat <= clip.Bounds[3] {
+				inside = true
+			}
+		}
+	}
+
+	if inside {
+		return false, nil
+	}
+	if bounds[0] > bounds[2] {
+		// No nodes at all
+		return false, nil
+	}
+	if bounds[0] > clip.Bounds[2] || bounds[2] < clip.Bounds[0] || bounds[1] > clip.Bounds[3] || bounds[3] < clip.Bounds[1] {
+		return true, nil
+	}
+
+	// Bounds overlap, the relation might still lie outside (or surround
+	// the clip area)
+	geom, err := relationGeometry(rel, src)
+	if err != nil {
+		return false, nil
+	}
+	intersects, err := clip.Prepared.Intersects(geom)
+	if err != nil {
+		return false, nil
+	}
+	return !intersects, nil
+}
+
+// Removes the given (replicated) relations when they lie outside of the clip
+// area, along with the ways and nodes that are no longer used by any other
+// relation. Returns the IDs of the removed relations.
+func (e *Env) pruneRelations(clip *clipArea, ids []int64) ([]int64, error) {
+	removed := make([]int64, 0)
+	for _, id := range ids {
+		if e.ctx.Err() != nil {
+			return removed, e.ctx.Err()
+		}
+
+		rel, err := e.GetRelation(id)
+		if err != nil {
+			return removed, err
+		}
+		if rel == nil {
+			continue
+		}
+
+		outside, err := outsideClipArea(clip, rel, e)
+		if err != nil {
+			return removed, err
+		}
+		if !outside {
+			continue
+		}
+
+		err = e.removeRelation(*rel)
+		if err != nil {
+			return removed, err
+		}
+		err = e.removeDerived([]int64{id})
+		if err != nil {
+			return removed, err
+		}
+		err = e.removeOrphans(rel)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, id)
+	}
+	return removed, nil
+}
+
+// Removes the ways of a (removed) relation that aren't used by any other
+// relation, along with their nodes that aren't part of any other way
+func (e *Env) removeOrphans(rel *model.Relation) error {
+	for _, m := range rel.GetMembers() {
+		if m.Type != int32(element.WAY) {
+			continue
+		}
+
+		rels, err := e.getWayRelations(m.Id)
+		if err != nil {
+			return err
+		}
+		if len(rels) > 0 {
+			continue
+		}
+
+		way, err := e.GetWay(m.Id)
+		if err != nil {
+			return err
+		}
+		if way == nil {
+			continue
+		}
+
+		err = e.removeWay(*way)
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range way.Refs {
+			ways, err := e.getNodeWays(ref)
+			if err != nil {
+				return err
+			}
+			if len(ways) > 0 {
+				continue
+			}
+
+			err = e.removeNode(model.Node{Id: ref})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package osmtopo
+
+import (
+	"testing"
+
+	"github.com/cheekybits/is"
+)
+
+func TestLoadClipArea(t *testing.T) {
+	is := is.New(t)
+
+	clip, err := loadClipArea(PBFSource{})
+	is.NoErr(err)
+	is.Nil(clip)
+
+	clip, err = loadClipArea(PBFSource{Clip: []float64{5.9, 49.4, 6.6, 50.2}})
+	is.NoErr(err)
+	is.NotNil(clip)
+	is.True(clip.IsBox)
+
+	// Min and max swapped
+	_, err = loadClipArea(PBFSource{Clip: []float64{6.6, 49.4, 5.9, 50.2}})
+	is.Err(err)
+
+	// Only one of both
+	_, err = loadClipArea(PBFSource{Clip: []float64{5.9, 49.4, 6.6, 50.2}, ClipFile: "area.geojson"})
+	is.Err(err)
+}
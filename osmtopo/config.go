@@ -5,6 +5,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/rubenv/osmtopo/osmtopo/model"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -12,6 +13,8 @@ const Day = 24 * time.Hour
 const DefaultWaterPolygons = "http://data.openstreetmapdata.com/water-polygons-split-4326.zip"
 const DefaultWaterUpdate = 4 * 7 * Day
 const DefaultExportPointLimit = 10000
+const DefaultKeepChanges = 4 * 7 * Day
+const DefaultMaxZoom = 12
 
 type Config struct {
 	// Where to download water polygons
@@ -29,6 +32,12 @@ type Config struct {
 	// Blacklist features
 	Blacklist []int64 `yaml:"blacklist" json:"blacklist"`
 
+	// Relations to store when importing, as a tag filter (see TagFilter).
+	// Relations matching the filter of a layer are always stored.
+	//
+	// Defaults to relations with an admin_level or natural=water.
+	Accept TagFilter `yaml:"accept" json:"accept"`
+
 	// Languages to extract (names, 2-letter codes)
 	Languages []string `yaml:"languages" json:"languages"`
 
@@ -42,6 +51,10 @@ type Config struct {
 
 	// Target number of points in generated topojson files
 	ExportPointLimit int `yaml:"export_point_limit" json:"export_point_limit"`
+
+	// How long to keep the journal of changed relations, in seconds,
+	// defaults to 4 weeks. Zero keeps it forever.
+	KeepChanges int64 `yaml:"keep_changes" json:"keep_changes"`
 }
 
 type PBFSource struct {
@@ -50,6 +63,17 @@ type PBFSource struct {
 
 	// URL to the .osc.gz replication files
 	Update string `yaml:"update" json:"update"`
+
+	// Area of interest, relations that lie entirely outside of it are
+	// dropped when importing and replicating. Either a bounding box (min
+	// lon, min lat, max lon, max lat) or a GeoJSON file with polygons.
+	Clip     []float64 `yaml:"clip" json:"clip"`
+	ClipFile string    `yaml:"clip_file" json:"clip_file"`
+
+	// How to import the seed: multi-pass (the default) or single-pass,
+	// which is faster for big files but needs temporary disk space for all
+	// ways and nodes.
+	ImportMode string `yaml:"import_mode" json:"import_mode"`
 }
 
 type Layer struct {
@@ -57,6 +81,36 @@ type Layer struct {
 	Name        string `yaml:"name" json:"name"`
 	AdminLevels []int  `yaml:"admin_levels" json:"admin_levels"`
 	Simplify    int    `yaml:"simplify" json:"simplify"`
+
+	// Relations to include, e.g. [boundary=postal_code]. When admin levels
+	// are given as well, relations need to match both.
+	//
+	// Relations and tags are selected when importing, so a filter on tags
+	// that weren't used before only matches after a re-import.
+	Filter TagFilter `yaml:"filter" json:"filter"`
+
+	// Output formats: topojson (sliced), geojson, ndjson, flatgeobuf,
+	// shapefile, mvt (a {z}/{x}/{y}.pbf tree) and mbtiles. Defaults to
+	// topojson. All of them end up in the /api/topologies archive.
+	Formats []string `yaml:"formats" json:"formats"`
+
+	// Zoom levels of vector tiles, defaults to 0 - DefaultMaxZoom
+	MinZoom int `yaml:"min_zoom" json:"min_zoom"`
+	MaxZoom int `yaml:"max_zoom" json:"max_zoom"`
+
+	// Extra OSM tags to export as properties, next to the ID and names.
+	//
+	// Tags are retained when importing, so adding a tag here only has an
+	// effect on relations that are imported (or replicated) afterwards.
+	Properties []Property `yaml:"properties" json:"properties"`
+}
+
+type Property struct {
+	// OSM tag, e.g. wikidata or ISO3166-2
+	Tag string `yaml:"tag" json:"tag"`
+
+	// Name of the output property, defaults to the tag
+	Name string `yaml:"name" json:"name"`
 }
 
 type MatchRule struct {
@@ -64,6 +118,133 @@ type MatchRule struct {
 	Restrict map[string][]int `yaml:"restrict" json:"restrict"`
 }
 
+// Returns the layer with the given ID, nil if not found
+func (c *Config) GetLayer(id string) *Layer {
+	for i, layer := range c.Layers {
+		if layer.ID == id {
+			return &c.Layers[i]
+		}
+	}
+	return nil
+}
+
+// Name of the output property
+func (p Property) OutputName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.Tag
+}
+
+// Checks whether a relation tag should be stored: the tags accepted by
+// AcceptTag, along with the tags that are exported as properties or used in
+// layer filters.
+func (c *Config) AcceptTag(k, v string) bool {
+	if AcceptTag(k, v) {
+		return true
+	}
+
+	for _, layer := range c.Layers {
+		for _, prop := range layer.Properties {
+			if prop.Tag == k {
+				return true
+			}
+		}
+		for _, key := range layer.Filter.Keys() {
+			if key == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks whether a relation should be stored
+func (c *Config) AcceptRelation(id int64, tags map[string]string) bool {
+	for _, blacklisted := range c.Blacklist {
+		if id == blacklisted {
+			return false
+		}
+	}
+
+	if len(c.Accept) > 0 {
+		if c.Accept.MatchesTags(tags) {
+			return true
+		}
+	} else if tags["admin_level"] != "" || tags["natural"] == "water" {
+		return true
+	}
+
+	for _, layer := range c.Layers {
+		if len(layer.Filter) > 0 && layer.Filter.MatchesTags(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether a relation belongs in the layer: it needs to have one of the
+// admin levels and match the filter, whichever of both are set.
+func (l Layer) Selects(rel *model.Relation) bool {
+	if len(l.AdminLevels) == 0 && len(l.Filter) == 0 {
+		return false
+	}
+
+	if len(l.AdminLevels) > 0 {
+		level := rel.GetAdminLevel()
+		found := false
+		for _, admin := range l.AdminLevels {
+			if admin == level {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return l.Filter.MatchesRelation(rel)
+}
+
+// Checks whether a rule applies, given the relation that was matched in each
+// layer. A rule without a match applies everywhere.
+func (r MatchRule) Applies(matched map[string]int64) bool {
+	for layer, id := range r.Match {
+		if matched[layer] != id {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks whether the matching rules allow a relation with the given admin
+// level in a layer, given the relation that was matched in each layer.
+func (c *Config) Allows(matched map[string]int64, layer string, adminLevel int) bool {
+	for _, rule := range c.Rules {
+		if !rule.Applies(matched) {
+			continue
+		}
+
+		levels, ok := rule.Restrict[layer]
+		if !ok {
+			continue
+		}
+
+		found := false
+		for _, level := range levels {
+			if level == adminLevel {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func ReadConfig(filename string) (*Config, error) {
 	fp, err := os.Open(filename)
 	if err != nil {
@@ -87,6 +268,7 @@ func NewConfig() *Config {
 		Water:            DefaultWaterPolygons,
 		UpdateWaterEvery: int64(DefaultWaterUpdate.Seconds()),
 		ExportPointLimit: DefaultExportPointLimit,
+		KeepChanges:      int64(DefaultKeepChanges.Seconds()),
 		Languages:        []string{"en"},
 	}
 }
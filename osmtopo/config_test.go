@@ -1,10 +1,12 @@
 package osmtopo
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 
 	"github.com/cheekybits/is"
+	"github.com/rubenv/osmtopo/osmtopo/model"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -15,6 +17,7 @@ sources:
     luxembourg:
         seed: http://download.geofabrik.de/europe/luxembourg-latest.osm.pbf
         update: http://download.geofabrik.de/europe/luxembourg-updates/
+        clip: [5.9, 49.4, 6.6, 50.2]
 
 layers:
     - id: districts
@@ -35,9 +38,233 @@ layers:
 	is.True(ok)
 	is.Equal(s.Seed, "http://download.geofabrik.de/europe/luxembourg-latest.osm.pbf")
 	is.Equal(s.Update, "http://download.geofabrik.de/europe/luxembourg-updates/")
+	is.Equal(s.Clip, []float64{5.9, 49.4, 6.6, 50.2})
 
 	is.Equal(len(cfg.Layers), 2)
 	l := cfg.Layers[0]
 	is.Equal(l.ID, "districts")
 	is.Equal(l.Name, "Districts")
+
+	is.Equal(cfg.GetLayer("cities").Name, "Cities")
+	is.Nil(cfg.GetLayer("countries"))
+}
+
+func TestOutputFormats(t *testing.T) {
+	is := is.New(t)
+
+	in := `
+layers:
+    - id: districts
+    - id: cities
+      formats: [geojson, flatgeobuf]
+`
+
+	cfg, err := ParseConfig(strings.NewReader(in))
+	is.NoErr(err)
+
+	formats, err := cfg.GetLayer("districts").OutputFormats()
+	is.NoErr(err)
+	is.Equal(formats, []string{"topojson"})
+	formats, err = cfg.GetLayer("cities").OutputFormats()
+	is.NoErr(err)
+	is.Equal(formats, []string{"geojson", "flatgeobuf"})
+
+	l := Layer{Formats: []string{"kml"}}
+	_, err = l.OutputFormats()
+	is.Err(err)
+}
+
+func TestZoomRange(t *testing.T) {
+	is := is.New(t)
+
+	in := `
+layers:
+    - id: districts
+    - id: cities
+      min_zoom: 4
+      max_zoom: 14
+`
+
+	cfg, err := ParseConfig(strings.NewReader(in))
+	is.NoErr(err)
+
+	minZoom, maxZoom := cfg.GetLayer("districts").ZoomRange()
+	is.Equal(minZoom, 0)
+	is.Equal(maxZoom, DefaultMaxZoom)
+	minZoom, maxZoom = cfg.GetLayer("cities").ZoomRange()
+	is.Equal(minZoom, 4)
+	is.Equal(maxZoom, 14)
+}
+
+func TestLayerProperties(t *testing.T) {
+	is := is.New(t)
+
+	in := `
+layers:
+    - id: cities
+      properties:
+        - tag: wikidata
+        - tag: ref:INS
+          name: nis
+`
+
+	cfg, err := ParseConfig(strings.NewReader(in))
+	is.NoErr(err)
+
+	props := cfg.GetLayer("cities").Properties
+	is.Equal(len(props), 2)
+	is.Equal(props[0].OutputName(), "wikidata")
+	is.Equal(props[1].OutputName(), "nis")
+
+	// Property tags are stored along with the names
+	is.True(cfg.AcceptTag("name:nl", "Brussel"))
+	is.True(cfg.AcceptTag("ref:INS", "21004"))
+	is.False(cfg.AcceptTag("population", "1000"))
+}
+
+func TestMatchRules(t *testing.T) {
+	is := is.New(t)
+
+	in := `
+layers:
+    - id: cities
+      admin_levels: [8]
+    - id: regions
+      admin_levels: [4, 6]
+    - id: countries
+      admin_levels: [2]
+
+rules:
+    - match:
+        countries: 52411 # Belgium
+      restrict:
+          regions: [6]
+    - match:
+        countries: 2323309 # The Netherlands
+      restrict:
+          regions: [4]
+`
+
+	cfg, err := ParseConfig(strings.NewReader(in))
+	is.NoErr(err)
+	is.Equal(len(cfg.Rules), 2)
+
+	belgium := map[string]int64{"countries": 52411}
+	netherlands := map[string]int64{"countries": 2323309}
+	unknown := map[string]int64{}
+
+	is.True(cfg.Rules[0].Applies(belgium))
+	is.False(cfg.Rules[0].Applies(netherlands))
+	is.False(cfg.Rules[0].Applies(unknown))
+
+	is.True(cfg.Allows(belgium, "regions", 6))
+	is.False(cfg.Allows(belgium, "regions", 4))
+	is.True(cfg.Allows(netherlands, "regions", 4))
+	is.False(cfg.Allows(netherlands, "regions", 6))
+
+	// Unrestricted layers and unmatched rules allow anything
+	is.True(cfg.Allows(belgium, "cities", 8))
+	is.True(cfg.Allows(unknown, "regions", 4))
+	is.True(cfg.Allows(unknown, "regions", 6))
+
+	// A rule without a match applies everywhere
+	in = `
+layers:
+    - id: cities
+      admin_levels: [8, 9]
+
+rules:
+    - restrict:
+          cities: [8]
+`
+
+	cfg, err = ParseConfig(strings.NewReader(in))
+	is.NoErr(err)
+	is.True(cfg.Rules[0].Applies(unknown))
+	is.True(cfg.Rules[0].Applies(belgium))
+	is.True(cfg.Allows(unknown, "cities", 8))
+	is.False(cfg.Allows(unknown, "cities", 9))
+}
+
+func TestFilters(t *testing.T) {
+	is := is.New(t)
+
+	in := `
+accept: [boundary=administrative|postal_code]
+
+layers:
+    - id: postcodes
+      filter: [boundary=postal_code, postal_code, "!disused"]
+    - id: municipalities
+      admin_levels: [8]
+      filter: boundary!=historic
+`
+
+	cfg, err := ParseConfig(strings.NewReader(in))
+	is.NoErr(err)
+	is.Equal(cfg.Accept.String(), "boundary=administrative|postal_code")
+
+	postcodes := cfg.GetLayer("postcodes")
+	is.Equal(len(postcodes.Filter), 3)
+	is.Equal(postcodes.Filter.String(), "boundary=postal_code postal_code !disused")
+	is.Equal(cfg.GetLayer("municipalities").Filter.String(), "boundary!=historic")
+
+	// The status API shows filters as expressions
+	data, err := json.Marshal(cfg.GetLayer("postcodes"))
+	is.NoErr(err)
+	is.True(strings.Contains(string(data), `"filter":["boundary=postal_code","postal_code","!disused"]`))
+	layer := Layer{}
+	is.NoErr(json.Unmarshal(data, &layer))
+	is.Equal(layer.Filter, postcodes.Filter)
+
+	// Tags used in filters are stored
+	is.True(cfg.AcceptTag("postal_code", "1000"))
+	is.True(cfg.AcceptTag("disused", "yes"))
+	is.False(cfg.AcceptTag("place", "city"))
+
+	is.True(cfg.AcceptRelation(1, map[string]string{"boundary": "postal_code"}))
+	is.True(cfg.AcceptRelation(2, map[string]string{"boundary": "administrative"}))
+	is.False(cfg.AcceptRelation(3, map[string]string{"admin_level": "8"}))
+	is.False(cfg.AcceptRelation(4, map[string]string{"natural": "water"}))
+
+	rel := func(tags ...string) *model.Relation {
+		r := &model.Relation{}
+		for i := 0; i < len(tags); i += 2 {
+			r.Tags = append(r.Tags, &model.TagEntry{Key: tags[i], Value: tags[i+1]})
+		}
+		return r
+	}
+
+	is.True(postcodes.Selects(rel("boundary", "postal_code", "postal_code", "1000")))
+	is.False(postcodes.Selects(rel("boundary", "postal_code")))
+	is.False(postcodes.Selects(rel("boundary", "postal_code", "postal_code", "1000", "disused", "yes")))
+
+	municipalities := cfg.GetLayer("municipalities")
+	is.True(municipalities.Selects(rel("admin_level", "8", "boundary", "administrative")))
+	is.False(municipalities.Selects(rel("admin_level", "8", "boundary", "historic")))
+	is.False(municipalities.Selects(rel("admin_level", "6", "boundary", "administrative")))
+
+	// Defaults: anything with an admin level, layers select on admin levels
+	cfg = NewConfig()
+	cfg.Blacklist = []int64{5}
+	is.True(cfg.AcceptRelation(1, map[string]string{"admin_level": "8"}))
+	is.True(cfg.AcceptRelation(2, map[string]string{"natural": "water"}))
+	is.False(cfg.AcceptRelation(3, map[string]string{"place": "city"}))
+	is.False(cfg.AcceptRelation(5, map[string]string{"admin_level": "8"}))
+	is.True(Layer{AdminLevels: []int{8}}.Selects(rel("admin_level", "8")))
+	is.False(Layer{}.Selects(rel("admin_level", "8")))
+
+	// Deprecated package function, applies the default rule
+	admin := rel("admin_level", "8")
+	admin.Id = 5
+	is.True(AcceptRelation(*admin, nil))
+	is.False(AcceptRelation(*admin, []int64{5}))
+	is.False(AcceptRelation(*rel("place", "city"), nil))
+
+	for _, expr := range []string{"", "=city", "place=", "!place=city", "a|b"} {
+		_, err := ParseTagFilter(expr)
+		is.Err(err)
+	}
+	_, err = ParseConfig(strings.NewReader("accept: [\"=x\"]"))
+	is.Err(err)
 }
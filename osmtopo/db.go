@@ -1,6 +1,7 @@
 package osmtopo
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path"
@@ -10,11 +11,12 @@ import (
 	"time"
 
 	"github.com/golang/geo/s2"
+	"github.com/omniscale/imposm3/element"
 	"github.com/rubenv/osmtopo/osmtopo/model"
 	"github.com/tecbot/gorocksdb"
 )
 
-func (e *Env) openStore() error {
+func (e *Env) openStore(readOnly bool) error {
 	// Determine max number of open files
 	var rLimit syscall.Rlimit
 	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
@@ -24,9 +26,11 @@ func (e *Env) openStore() error {
 	maxOpen := int(rLimit.Cur - 100)
 
 	storeFolder := path.Join(e.storePath, "ldb")
-	err = os.MkdirAll(storeFolder, 0755)
-	if err != nil {
-		return err
+	if !readOnly {
+		err = os.MkdirAll(storeFolder, 0755)
+		if err != nil {
+			return err
+		}
 	}
 
 	opts := gorocksdb.NewDefaultOptions()
@@ -37,7 +41,13 @@ func (e *Env) openStore() error {
 	opts.SetBlockBasedTableFactory(bb)
 	opts.SetMaxOpenFiles(maxOpen)
 	opts.SetMaxBackgroundCompactions(1)
-	db, err := gorocksdb.OpenDb(opts, storeFolder)
+
+	var db *gorocksdb.DB
+	if readOnly {
+		db, err = gorocksdb.OpenDbForReadOnly(opts, storeFolder, false)
+	} else {
+		db, err = gorocksdb.OpenDb(opts, storeFolder)
+	}
 	if err != nil {
 		return err
 	}
@@ -296,6 +306,20 @@ func (e *Env) addNewNodes(arr []model.Node) error {
 }
 
 func (e *Env) addNewWays(arr []model.Way) error {
+	return e.writeWays(arr, false)
+}
+
+// Stores ways that may already exist, cleaning up the reverse index entries
+// of the previous version
+func (e *Env) replaceWays(arr []model.Way) error {
+	return e.writeWays(arr, true)
+}
+
+func (e *Env) writeWays(arr []model.Way, replace bool) error {
+	if replace {
+		arr = lastWayVersions(arr)
+	}
+
 	wb := gorocksdb.NewWriteBatch()
 	defer wb.Destroy()
 	for _, n := range arr {
@@ -303,12 +327,33 @@ func (e *Env) addNewWays(arr []model.Way) error {
 		if err != nil {
 			return err
 		}
+		if replace {
+			err = e.unindexWay(wb, n.Id)
+			if err != nil {
+				return err
+			}
+		}
 		wb.Put(wayKey(n.Id), data)
+		indexWay(wb, n)
 	}
 	return e.db.Write(e.wo, wb)
 }
 
 func (e *Env) addNewRelations(arr []model.Relation) error {
+	return e.writeRelations(arr, false)
+}
+
+// Stores relations that may already exist, cleaning up the reverse index
+// entries of the previous version
+func (e *Env) replaceRelations(arr []model.Relation) error {
+	return e.writeRelations(arr, true)
+}
+
+func (e *Env) writeRelations(arr []model.Relation, replace bool) error {
+	if replace {
+		arr = lastRelationVersions(arr)
+	}
+
 	wb := gorocksdb.NewWriteBatch()
 	defer wb.Destroy()
 	for _, n := range arr {
@@ -316,11 +361,58 @@ func (e *Env) addNewRelations(arr []model.Relation) error {
 		if err != nil {
 			return err
 		}
+		if replace {
+			err = e.unindexRelation(wb, n.Id)
+			if err != nil {
+				return err
+			}
+		}
 		wb.Put(relationKey(n.Id), data)
+		indexRelation(wb, n)
 	}
 	return e.db.Write(e.wo, wb)
 }
 
+// Keeps only the last version of each way. Replacing unindexes the stored
+// version, so the index entries of earlier versions in the same batch would
+// never be removed.
+func lastWayVersions(arr []model.Way) []model.Way {
+	last := make(map[int64]int, len(arr))
+	for i, n := range arr {
+		last[n.Id] = i
+	}
+	if len(last) == len(arr) {
+		return arr
+	}
+
+	result := make([]model.Way, 0, len(last))
+	for i, n := range arr {
+		if last[n.Id] == i {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// Keeps only the last version of each relation, see lastWayVersions
+func lastRelationVersions(arr []model.Relation) []model.Relation {
+	last := make(map[int64]int, len(arr))
+	for i, n := range arr {
+		last[n.Id] = i
+	}
+	if len(last) == len(arr) {
+		return arr
+	}
+
+	result := make([]model.Relation, 0, len(last))
+	for i, n := range arr {
+		if last[n.Id] == i {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
 func (e *Env) removeNode(n model.Node) error {
 	wb := gorocksdb.NewWriteBatch()
 	defer wb.Destroy()
@@ -331,6 +423,10 @@ func (e *Env) removeNode(n model.Node) error {
 func (e *Env) removeWay(n model.Way) error {
 	wb := gorocksdb.NewWriteBatch()
 	defer wb.Destroy()
+	err := e.unindexWay(wb, n.Id)
+	if err != nil {
+		return err
+	}
 	wb.Delete(wayKey(n.Id))
 	return e.db.Write(e.wo, wb)
 }
@@ -338,10 +434,187 @@ func (e *Env) removeWay(n model.Way) error {
 func (e *Env) removeRelation(n model.Relation) error {
 	wb := gorocksdb.NewWriteBatch()
 	defer wb.Destroy()
+	err := e.unindexRelation(wb, n.Id)
+	if err != nil {
+		return err
+	}
 	wb.Delete(relationKey(n.Id))
 	return e.db.Write(e.wo, wb)
 }
 
+// Adds the reverse index entries (node -> way) of a way
+func indexWay(wb *gorocksdb.WriteBatch, n model.Way) {
+	for _, ref := range n.Refs {
+		wb.Put(nodeWayKey(ref, n.Id), nil)
+	}
+}
+
+// Adds the reverse index entries (way -> relation) of a relation
+func indexRelation(wb *gorocksdb.WriteBatch, n model.Relation) {
+	for _, m := range n.Members {
+		if m.Type == int32(element.WAY) {
+			wb.Put(wayRelationKey(m.Id, n.Id), nil)
+		}
+	}
+}
+
+// Removes the reverse index entries of the stored version of a way
+func (e *Env) unindexWay(wb *gorocksdb.WriteBatch, id int64) error {
+	way, err := e.GetWay(id)
+	if err != nil {
+		return err
+	}
+	if way == nil {
+		return nil
+	}
+
+	for _, ref := range way.Refs {
+		wb.Delete(nodeWayKey(ref, id))
+	}
+	return nil
+}
+
+// Removes the reverse index entries of the stored version of a relation
+func (e *Env) unindexRelation(wb *gorocksdb.WriteBatch, id int64) error {
+	rel, err := e.GetRelation(id)
+	if err != nil {
+		return err
+	}
+	if rel == nil {
+		return nil
+	}
+
+	for _, m := range rel.Members {
+		if m.Type == int32(element.WAY) {
+			wb.Delete(wayRelationKey(m.Id, id))
+		}
+	}
+	return nil
+}
+
+// Returns the IDs of the ways that refer to a node
+func (e *Env) getNodeWays(id int64) ([]int64, error) {
+	r := e.newReverseIndex()
+	defer r.Close()
+	return r.nodeWays(id)
+}
+
+// Returns the IDs of the relations that have a way as a member
+func (e *Env) getWayRelations(id int64) ([]int64, error) {
+	r := e.newReverseIndex()
+	defer r.Close()
+	return r.wayRelations(id)
+}
+
+// Reads the reverse indexes, reusing one iterator for many lookups
+type reverseIndex struct {
+	ro *gorocksdb.ReadOptions
+	it *gorocksdb.Iterator
+}
+
+func (e *Env) newReverseIndex() *reverseIndex {
+	ro := gorocksdb.NewDefaultReadOptions()
+	ro.SetFillCache(false)
+	return &reverseIndex{ro: ro, it: e.db.NewIterator(ro)}
+}
+
+func (r *reverseIndex) Close() {
+	r.it.Close()
+	r.ro.Destroy()
+}
+
+func (r *reverseIndex) nodeWays(id int64) ([]int64, error) {
+	return r.scan(nodeWayKey(id, 0)[:17])
+}
+
+func (r *reverseIndex) wayRelations(id int64) ([]int64, error) {
+	return r.scan(wayRelationKey(id, 0)[:16])
+}
+
+func (r *reverseIndex) scan(prefix []byte) ([]int64, error) {
+	it := r.it
+
+	result := make([]int64, 0)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Key()
+		k := key.Data()
+		if len(k) == len(prefix)+8 {
+			result = append(result, int64(binary.BigEndian.Uint64(k[len(prefix):])))
+		}
+		key.Free()
+	}
+
+	return result, it.Err()
+}
+
+// Removes the derived data of relations: cached geometries and coverages
+func (e *Env) removeDerived(ids []int64) error {
+	clipPrefixes, err := e.clipPrefixes()
+	if err != nil {
+		return err
+	}
+
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, id := range ids {
+		wb.Delete([]byte(fmt.Sprintf("geometry/rel/%d", id)))
+		wb.Delete([]byte(fmt.Sprintf("s2/%d", id)))
+		for _, prefix := range clipPrefixes {
+			wb.Delete([]byte(fmt.Sprintf("geometry/%s/%d", prefix, id)))
+		}
+	}
+	return e.db.Write(e.wo, wb)
+}
+
+// Geometry prefixes of all stored clipped geometry caches. Includes those of
+// removed layers and earlier simplifications, which would otherwise be reused
+// once the config changes back.
+func (e *Env) clipPrefixes() ([]string, error) {
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+
+	it := e.db.NewIterator(ro)
+	defer it.Close()
+
+	result := make([]string, 0)
+	keyPrefix := []byte("geometry/clip/")
+	it.Seek(keyPrefix)
+	for it.ValidForPrefix(keyPrefix) {
+		key := it.Key()
+		k := string(key.Data())
+		key.Free()
+
+		// Keys are geometry/clip/<layer>/<simplify>/<id>
+		end := strings.LastIndex(k, "/")
+		if end < len(keyPrefix) {
+			it.Next()
+			continue
+		}
+		result = append(result, k[len("geometry/"):end])
+
+		// Skip the remaining keys of this prefix
+		it.Seek([]byte(k[:end] + "0"))
+	}
+	return result, it.Err()
+}
+
+// Drops all clipped geometries, needed when the water polygons change
+func (e *Env) removeClippedGeometries() error {
+	prefixes, err := e.clipPrefixes()
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		err := e.removeGeometries(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *Env) GetNode(id int64) (*model.Node, error) {
 	n, err := e.db.Get(e.ro, nodeKey(id))
 	if err != nil {
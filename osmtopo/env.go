@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -23,29 +24,40 @@ import (
 	"github.com/paulsmith/gogeos/geos"
 	"github.com/rubenv/osmtopo/osmtopo/lookup"
 	"github.com/rubenv/osmtopo/osmtopo/model"
+	"github.com/rubenv/osmtopo/osmtopo/mvt"
 	"github.com/rubenv/servertiming"
 	"github.com/rubenv/topojson"
 	"github.com/tecbot/gorocksdb"
+	"github.com/uber-go/atomic"
 	"golang.org/x/sync/errgroup"
 )
 
 type Env struct {
-	ctx  context.Context
-	cf   context.CancelFunc
-	done sync.WaitGroup
+	ctx      context.Context
+	cf       context.CancelFunc
+	done     sync.WaitGroup
+	stopOnce sync.Once
 
 	initialized sync.WaitGroup
 
+	// Outcome of the first update run by the background updater
+	firstUpdate    sync.WaitGroup
+	firstUpdateErr error
+
 	config         *Config
 	topologiesFile string
 	storePath      string
 	outputPath     string
+	readOnly       bool
 
 	db *gorocksdb.DB
 	wo *gorocksdb.WriteOptions
 	ro *gorocksdb.ReadOptions
 
+	// Replaced while requests query them
+	lookupLock sync.RWMutex
 	lookup     *lookup.Data
+	lookupKey  string
 	topologies *lookup.Data
 
 	topoData  *TopologyData
@@ -55,7 +67,9 @@ type Env struct {
 	waterLock     sync.Mutex
 	waterClipGeos map[string][]*clipGeometry
 
-	Status Status
+	Status     Status
+	statusLock sync.Mutex
+	events     eventBroker
 }
 
 type Status struct {
@@ -65,21 +79,66 @@ type Status struct {
 	Config      *Config `json:"config"`
 
 	Export ExportStatus `json:"export"`
+
+	// Import or replication that's running, if any
+	Progress *Progress `json:"progress"`
+}
+
+// Progress of an import or replication
+type Progress struct {
+	Source  string    `json:"source"`
+	Task    string    `json:"task"` // import or replicate
+	Phase   string    `json:"phase"`
+	Started time.Time `json:"started"`
+
+	// Imported elements and how many per second
+	Nodes        int64 `json:"nodes"`
+	Ways         int64 `json:"ways"`
+	Relations    int64 `json:"relations"`
+	NodeRate     int64 `json:"node_rate"`
+	WayRate      int64 `json:"way_rate"`
+	RelationRate int64 `json:"relation_rate"`
+
+	// Replication sequences: where it started, the one being applied and
+	// the latest available one
+	FromSequence int64 `json:"from_sequence,omitempty"`
+	Sequence     int64 `json:"sequence,omitempty"`
+	ToSequence   int64 `json:"to_sequence,omitempty"`
+
+	// Estimated completion of the phase, when it can be determined
+	ETA *time.Time `json:"eta,omitempty"`
+}
+
+// Estimates when work completes, based on the average rate so far
+func estimateCompletion(started time.Time, done, total int64) *time.Time {
+	if total <= 0 || done <= 0 {
+		return nil
+	}
+
+	remaining := total - done
+	if remaining < 0 {
+		remaining = 0
+	}
+	elapsed := time.Since(started)
+	eta := time.Now().Add(time.Duration(float64(elapsed) * float64(remaining) / float64(done)))
+	return &eta
 }
 
 type ExportStatus struct {
-	Running bool   `json:"running"`
-	Error   string `json:"error"`
+	Running bool                 `json:"running"`
+	Error   string               `json:"error"`
+	Layers  []*LayerExportStatus `json:"layers"`
 }
 
 func NewEnv(config *Config, topologiesFile, storePath, outputPath string) (*Env, error) {
-	env, err := prepareEnv(config, topologiesFile, storePath, outputPath)
+	env, err := prepareEnv(config, topologiesFile, storePath, outputPath, false)
 	if err != nil {
 		return nil, err
 	}
 
 	env.done.Add(1)
 	env.initialized.Add(1)
+	env.firstUpdate.Add(1)
 	go env.runUpdater()
 
 	err = env.loadTopologies()
@@ -91,13 +150,42 @@ func NewEnv(config *Config, topologiesFile, storePath, outputPath string) (*Env,
 	if err != nil {
 		return nil, err
 	}
-	env.Status.Missing = c
+	env.setMissing(c)
+
+	return env, nil
+}
+
+// Opens an environment without starting the background updater. Useful for
+// one-off tasks such as importing or inspecting data.
+func OpenEnv(config *Config, topologiesFile, storePath, outputPath string) (*Env, error) {
+	return openEnv(config, topologiesFile, storePath, outputPath, false)
+}
+
+// Opens an environment with a read-only data store, which can be used while
+// another process (e.g. the server) is writing to the store. Anything that
+// needs to write (such as caching geometries) will fail.
+func OpenEnvReadOnly(config *Config, topologiesFile, storePath, outputPath string) (*Env, error) {
+	return openEnv(config, topologiesFile, storePath, outputPath, true)
+}
+
+func openEnv(config *Config, topologiesFile, storePath, outputPath string, readOnly bool) (*Env, error) {
+	env, err := prepareEnv(config, topologiesFile, storePath, outputPath, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	topoData, err := ReadTopologies(topologiesFile)
+	if err != nil {
+		env.Stop()
+		return nil, err
+	}
+	env.topoData = topoData
 
 	return env, nil
 }
 
 // Used for testing
-func prepareEnv(config *Config, topologiesFile, storePath, outputPath string) (*Env, error) {
+func prepareEnv(config *Config, topologiesFile, storePath, outputPath string, readOnly bool) (*Env, error) {
 	ctx, cf := context.WithCancel(context.Background())
 
 	topoCache, err := lru.New(1024)
@@ -117,11 +205,12 @@ func prepareEnv(config *Config, topologiesFile, storePath, outputPath string) (*
 		topologiesFile: topologiesFile,
 		storePath:      storePath,
 		outputPath:     outputPath,
+		readOnly:       readOnly,
 		topoCache:      topoCache,
 		geosCache:      geosCache,
 		waterClipGeos:  make(map[string][]*clipGeometry),
 	}
-	err = env.openStore()
+	err = env.openStore(readOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -132,9 +221,11 @@ func prepareEnv(config *Config, topologiesFile, storePath, outputPath string) (*
 }
 
 func (e *Env) Stop() {
-	e.cf()
-	e.done.Wait()
-	e.db.Close()
+	e.stopOnce.Do(func() {
+		e.cf()
+		e.done.Wait()
+		e.db.Close()
+	})
 }
 
 func (e *Env) StartServer(listen string) error {
@@ -143,6 +234,7 @@ func (e *Env) StartServer(listen string) error {
 
 	mux := http.NewServeMux()
 	mux.Handle("/api/status", http.HandlerFunc(e.handleStatus))
+	mux.Handle("/api/events", http.HandlerFunc(e.handleEvents))
 	mux.Handle("/api/missing", http.HandlerFunc(e.handleMissing))
 	mux.Handle("/api/coordinate", http.HandlerFunc(e.handleCoordinate))
 	mux.Handle("/api/topo/", http.HandlerFunc(e.handleTopo))
@@ -155,6 +247,9 @@ func (e *Env) StartServer(listen string) error {
 	mux.Handle("/api/delete", http.HandlerFunc(e.handleDelete))
 	mux.Handle("/api/export", http.HandlerFunc(e.handleExport))
 	mux.Handle("/api/topologies", http.HandlerFunc(e.handleExportTopologies))
+	mux.Handle("/api/lookup", http.HandlerFunc(e.handleLookup))
+	mux.Handle("/api/changes", http.HandlerFunc(e.handleChanges))
+	mux.Handle("/api/tiles/", http.HandlerFunc(e.handleTiles))
 	mux.Handle("/", http.FileServer(packr.NewBox("../frontend/build")))
 
 	s := &http.Server{
@@ -181,22 +276,36 @@ func (e *Env) StartServer(listen string) error {
 func (e *Env) runUpdater() {
 	defer e.done.Done()
 
+	// Serve lookups from the persisted index while the first update runs
+	fingerprint, err := e.lookupFingerprint()
+	if err == nil {
+		_, err = e.restoreLookup(fingerprint)
+	}
+	if err != nil {
+		e.log("lookup", "Failed to restore index: %s", err)
+	}
+
 	done := e.ctx.Done()
+	first := true
 	for {
-		e.Status.Running = true
+		e.setRunning(true)
 		nextRun := time.Now().Add(1 * time.Hour)
 
 		err := e.updateData()
 		if err != nil {
 			e.log("updater", "Failed: %s", err)
 		} else {
-			if !e.Status.Initialized {
+			if e.setInitialized() {
 				e.initialized.Done()
-				e.Status.Initialized = true
 			}
 		}
+		if first {
+			e.firstUpdateErr = err
+			e.firstUpdate.Done()
+			first = false
+		}
 
-		e.Status.Running = false
+		e.setRunning(false)
 
 		select {
 		case <-time.After(time.Until(nextRun)):
@@ -206,18 +315,12 @@ func (e *Env) runUpdater() {
 	}
 }
 
-func (e *Env) runExporter() {
-	e.done.Add(1)
-	defer e.done.Done()
-
-	e.Status.Export.Running = true
-	err := e.export()
-	if err != nil {
-		e.Status.Export.Error = err.Error()
-	} else {
-		e.Status.Export.Error = ""
-	}
-	e.Status.Export.Running = false
+// Waits for the first update of the background updater and returns its error.
+// A failed update is retried an hour later, so callers that can't wait that
+// long (such as a one-off export) should give up when this fails.
+func (e *Env) WaitFirstUpdate() error {
+	e.firstUpdate.Wait()
+	return e.firstUpdateErr
 }
 
 func (e *Env) log(section, str string, args ...interface{}) {
@@ -249,14 +352,58 @@ func (e *Env) updateData() error {
 }
 
 func (e *Env) loadLookup() error {
-	lookupData := lookup.New()
-	for _, layer := range e.config.Layers {
-		levelNeeded := make(map[int]bool)
-		for _, admin := range layer.AdminLevels {
-			levelNeeded[admin] = true
+	fingerprint, err := e.lookupFingerprint()
+	if err != nil {
+		return err
+	}
+
+	ok, err := e.restoreLookup(fingerprint)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	lookupData, err := e.buildLookup()
+	if err != nil {
+		return err
+	}
+
+	if !e.readOnly {
+		err = e.writeLookupIndex(fingerprint, lookupData)
+		if err != nil {
+			return err
 		}
+	}
+
+	e.setLookup(lookupData, fingerprint)
+	return nil
+}
 
+func (e *Env) setLookup(data *lookup.Data, fingerprint string) {
+	e.lookupLock.Lock()
+	defer e.lookupLock.Unlock()
+	e.lookup = data
+	e.lookupKey = fingerprint
+}
+
+// Returns the lookup index of all relations when all is set, otherwise the
+// one of the selected topologies. Nil when it isn't loaded yet.
+func (e *Env) lookupIndex(all bool) *lookup.Data {
+	e.lookupLock.RLock()
+	defer e.lookupLock.RUnlock()
+	if all {
+		return e.lookup
+	}
+	return e.topologies
+}
+
+func (e *Env) buildLookup() (*lookup.Data, error) {
+	lookupData := lookup.New()
+	for _, layer := range e.config.Layers {
 		relations := make(chan *model.Relation, 100)
+		selected := atomic.NewInt64(0)
 
 		g, ctx := errgroup.WithContext(e.ctx)
 		g.Go(func() error {
@@ -295,9 +442,10 @@ func (e *Env) loadLookup() error {
 						return nil
 					}
 
-					if !levelNeeded[rel.GetAdminLevel()] {
+					if !layer.Selects(rel) {
 						continue
 					}
+					selected.Inc()
 
 					cov, err := e.GetS2Coverage(rel.Id)
 					if err != nil {
@@ -337,18 +485,20 @@ func (e *Env) loadLookup() error {
 
 		err := g.Wait()
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		if selected.Load() == 0 && len(layer.Filter) > 0 {
+			e.log("lookup", "Filter of layer %s (%s) selects no relations, tags only get stored when importing", layer.ID, layer.Filter)
 		}
 	}
 
 	err := lookupData.Build()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	e.lookup = lookupData
-
-	return nil
+	return lookupData, nil
 }
 
 func (e *Env) loadTopologies() error {
@@ -400,7 +550,9 @@ func (e *Env) loadTopologies() error {
 		return err
 	}
 
+	e.lookupLock.Lock()
 	e.topologies = lookup
+	e.lookupLock.Unlock()
 
 	return nil
 }
@@ -412,15 +564,8 @@ func (e *Env) getTopology(layerID string, id int64) (*topojson.Topology, *server
 		return t.(*topojson.Topology), nil, nil
 	}
 
-	var layer Layer
-	found := false
-	for _, l := range e.config.Layers {
-		if l.ID == layerID {
-			found = true
-			layer = l
-		}
-	}
-	if !found {
+	layer := e.config.GetLayer(layerID)
+	if layer == nil {
 		return nil, nil, fmt.Errorf("Unknown layer: %s", layerID)
 	}
 
@@ -440,8 +585,18 @@ func (e *Env) getTopology(layerID string, id int64) (*topojson.Topology, *server
 }
 
 func (e *Env) handleStatus(w http.ResponseWriter, req *http.Request) {
+	status := e.status()
+
 	req.Header.Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(e.Status)
+	json.NewEncoder(w).Encode(status)
+}
+
+// Publishes the progress of an import or replication, nil when done
+func (e *Env) setProgress(p *Progress) {
+	e.statusLock.Lock()
+	e.Status.Progress = p
+	e.events.publish(EventProgress, p)
+	e.statusLock.Unlock()
 }
 
 func (e *Env) handleMissing(w http.ResponseWriter, req *http.Request) {
@@ -514,7 +669,7 @@ func (e *Env) handleAdd(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	added := false
+	added := make([]TopologyEvent, 0)
 	for _, layer := range e.config.Layers {
 		id, ok := in[layer.ID]
 		if !ok {
@@ -523,10 +678,10 @@ func (e *Env) handleAdd(w http.ResponseWriter, req *http.Request) {
 
 		e.topoData.Add(layer.ID, id)
 
-		added = true
+		added = append(added, TopologyEvent{Layer: layer.ID, ID: id})
 	}
 
-	if added {
+	if len(added) > 0 {
 		err = e.topoData.WriteTo(e.topologiesFile)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -538,6 +693,11 @@ func (e *Env) handleAdd(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		e.removeTileCache()
+
+		for _, t := range added {
+			e.publish(EventTopologyAdded, t)
+		}
 	}
 }
 
@@ -560,7 +720,7 @@ func (e *Env) handleDelete(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	e.Status.Missing--
+	e.missingResolved()
 }
 
 func (e *Env) handleExport(w http.ResponseWriter, req *http.Request) {
@@ -569,16 +729,31 @@ func (e *Env) handleExport(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	go e.runExporter()
+	incremental := false
+	if v := req.URL.Query().Get("incremental"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid incremental: %s", err), http.StatusBadRequest)
+			return
+		}
+		incremental = b
+	}
+
+	if !e.startExport() {
+		http.Error(w, "Export is currently running", http.StatusBadRequest)
+		return
+	}
+	go e.runStartedExport(incremental)
 }
 
 func (e *Env) handleExportTopologies(w http.ResponseWriter, req *http.Request) {
-	if e.Status.Export.Running {
+	export := e.status().Export
+	if export.Running {
 		http.Error(w, "Export is currently running", http.StatusBadRequest)
 		return
 	}
-	if e.Status.Export.Error != "" {
-		http.Error(w, fmt.Sprintf("Export failed: %s", e.Status.Export.Error), http.StatusInternalServerError)
+	if export.Error != "" {
+		http.Error(w, fmt.Sprintf("Export failed: %s", export.Error), http.StatusInternalServerError)
 		return
 	}
 
@@ -616,6 +791,31 @@ func (e *Env) handleExportTopologies(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	addFile := func(name string, file os.FileInfo) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0600,
+			Size: file.Size(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return copyFile(path.Join(e.outputPath, name))
+	}
+
+	for _, file := range levels {
+		if file.Name() != manifestFile {
+			continue
+		}
+
+		err = addFile(file.Name(), file)
+		if err != nil {
+			writeErrorFile(err)
+			return
+		}
+	}
+
 	for _, level := range levels {
 		if !level.IsDir() || strings.HasPrefix(level.Name(), ".") {
 			continue
@@ -630,26 +830,39 @@ func (e *Env) handleExportTopologies(w http.ResponseWriter, req *http.Request) {
 		}
 
 		for _, file := range files {
-			filename := path.Join(folder, file.Name())
-			if !strings.HasSuffix(filename, ".topojson") {
+			if !isExportFile(file.Name()) {
 				continue
 			}
 
-			err = tw.WriteHeader(&tar.Header{
-				Name: fmt.Sprintf("%s/%s", level.Name(), file.Name()),
-				Mode: 0600,
-				Size: file.Size(),
-			})
+			err = addFile(path.Join(level.Name(), file.Name()), file)
 			if err != nil {
 				writeErrorFile(err)
 				return
 			}
+		}
 
-			err = copyFile(filename)
+		// Vector tile tree, if any
+		tiles := path.Join(folder, tilesFolder)
+		if _, err := os.Stat(tiles); os.IsNotExist(err) {
+			continue
+		}
+		err = filepath.Walk(tiles, func(filename string, file os.FileInfo, err error) error {
 			if err != nil {
-				writeErrorFile(err)
-				return
+				return err
 			}
+			if file.IsDir() || !strings.HasSuffix(filename, ".pbf") {
+				return nil
+			}
+
+			name, err := filepath.Rel(e.outputPath, filename)
+			if err != nil {
+				return err
+			}
+			return addFile(filepath.ToSlash(name), file)
+		})
+		if err != nil {
+			writeErrorFile(err)
+			return
 		}
 	}
 }
@@ -790,6 +1003,19 @@ func (e *Env) handleGeometry(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		prefixes, err := e.clipPrefixes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, prefix := range prefixes {
+			err = e.removeGeometry(prefix, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		e.removeTileCache()
 	default:
 		http.Error(w, fmt.Sprintf("Method not allowed: %s", req.Method), http.StatusBadRequest)
 		return
@@ -897,3 +1123,175 @@ func (e *Env) handleNode(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+func (e *Env) handleLookup(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	all := false
+	switch q.Get("source") {
+	case "", "topologies":
+	case "all":
+		all = true
+	default:
+		http.Error(w, fmt.Sprintf("Unknown source: %s", q.Get("source")), http.StatusBadRequest)
+		return
+	}
+
+	index := e.lookupIndex(all)
+	if index == nil {
+		http.Error(w, "Lookup index not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	layers := q["layer"]
+	for _, layer := range layers {
+		if e.config.GetLayer(layer) == nil {
+			http.Error(w, fmt.Sprintf("Unknown layer: %s", layer), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch req.Method {
+	case "GET":
+		lat, err := strconv.ParseFloat(q.Get("lat"), 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid lat: %s", err), http.StatusBadRequest)
+			return
+		}
+		lon, err := strconv.ParseFloat(q.Get("lon"), 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid lon: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		result, err := e.lookupPoint(index, lat, lon, layers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "POST":
+		points := make([]LookupPoint, 0)
+		err := json.NewDecoder(req.Body).Decode(&points)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(points) > MaxLookupBatch {
+			http.Error(w, fmt.Sprintf("Too many points, at most %d allowed", MaxLookupBatch), http.StatusBadRequest)
+			return
+		}
+
+		results := make([]*LookupResult, 0, len(points))
+		for _, p := range points {
+			result, err := e.lookupPoint(index, p.Lat, p.Lon, layers)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			results = append(results, result)
+		}
+
+		err = json.NewEncoder(w).Encode(results)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Method not allowed: %s", req.Method), http.StatusBadRequest)
+		return
+	}
+}
+
+func (e *Env) handleChanges(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Should send a GET request", http.StatusBadRequest)
+		return
+	}
+
+	q := req.URL.Query()
+
+	since := int64(0)
+	if q.Get("since") != "" {
+		s, err := strconv.ParseInt(q.Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid since: %s", err), http.StatusBadRequest)
+			return
+		}
+		since = s
+	}
+
+	source := q.Get("source")
+	if source != "" {
+		if _, ok := e.config.Sources[source]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown source: %s", source), http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := e.GetChanges(source, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (e *Env) handleTiles(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Should send a GET request", http.StatusBadRequest)
+		return
+	}
+
+	// /api/tiles/{layer}/{z}/{x}/{y}
+	parts := strings.Split(req.URL.Path, "/")
+	if len(parts) != 7 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	layer := e.config.GetLayer(parts[3])
+	if layer == nil {
+		http.Error(w, fmt.Sprintf("Unknown layer: %s", parts[3]), http.StatusNotFound)
+		return
+	}
+
+	coords := make([]int, 3)
+	for i, part := range parts[4:] {
+		v, err := strconv.Atoi(strings.TrimSuffix(part, ".pbf"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		coords[i] = v
+	}
+	tile := mvt.Tile{Z: coords[0], X: coords[1], Y: coords[2]}
+
+	minZoom, maxZoom := layer.ZoomRange()
+	if !tile.Valid() || tile.Z < minZoom || tile.Z > maxZoom {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	data, err := e.getTile(layer, tile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(data)
+}
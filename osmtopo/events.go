@@ -0,0 +1,270 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events pushed to /api/events
+const (
+	// Full status, sent when a client connects
+	EventStatus = "status"
+
+	EventUpdaterStarted  = "updater.started"
+	EventUpdaterFinished = "updater.finished"
+	EventInitialized     = "initialized"
+
+	EventExportStarted  = "export.started"
+	EventExportFinished = "export.finished"
+	EventExportFailed   = "export.failed"
+
+	EventMissing       = "missing"
+	EventProgress      = "progress"
+	EventTopologyAdded = "topology.added"
+)
+
+const (
+	// Reconnection delay suggested to clients
+	eventsRetry = 5 * time.Second
+
+	// Comments sent on idle streams, so proxies don't close them
+	eventsKeepAlive = 15 * time.Second
+
+	// Streams end before the write timeout of the server kicks in. Clients
+	// reconnect and get a fresh status.
+	eventsMaxDuration = 50 * time.Second
+
+	// Subscribers that fall this far behind get disconnected
+	eventsBuffer = 64
+)
+
+type Event struct {
+	Type string
+	Data []byte
+}
+
+// Payload of EventMissing
+type MissingEvent struct {
+	Missing int `json:"missing"`
+}
+
+// Payload of EventTopologyAdded
+type TopologyEvent struct {
+	Layer string `json:"layer"`
+	ID    int64  `json:"id"`
+}
+
+// Distributes events to all connected clients
+type eventBroker struct {
+	lock        sync.Mutex
+	subscribers map[chan *Event]struct{}
+}
+
+func (b *eventBroker) subscribe() chan *Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan *Event]struct{})
+	}
+	ch := make(chan *Event, eventsBuffer)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan *Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Never blocks: subscribers that can't keep up are dropped, which closes
+// their stream
+func (b *eventBroker) publish(typ string, data interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.subscribers) == 0 {
+		return
+	}
+
+	ev := &Event{Type: typ}
+	if data != nil {
+		d, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		ev.Data = d
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func writeEvent(w io.Writer, ev *Event) error {
+	data := ev.Data
+	if data == nil {
+		data = []byte("{}")
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
+
+// Publishes an event that isn't tied to a status change
+func (e *Env) publish(typ string, data interface{}) {
+	e.statusLock.Lock()
+	e.events.publish(typ, data)
+	e.statusLock.Unlock()
+}
+
+// Consistent copy of the status
+func (e *Env) status() Status {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+	return e.Status
+}
+
+func (e *Env) setRunning(running bool) {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+
+	e.Status.Running = running
+	if running {
+		e.events.publish(EventUpdaterStarted, nil)
+	} else {
+		e.events.publish(EventUpdaterFinished, nil)
+	}
+}
+
+// Marks the first update as done, returns false if that already happened
+func (e *Env) setInitialized() bool {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+
+	if e.Status.Initialized {
+		return false
+	}
+	e.Status.Initialized = true
+	e.events.publish(EventInitialized, nil)
+	return true
+}
+
+func (e *Env) setMissing(c int) {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+
+	if e.Status.Missing == c {
+		return
+	}
+	e.Status.Missing = c
+	e.events.publish(EventMissing, MissingEvent{Missing: c})
+}
+
+// Records that a missing coordinate got resolved
+func (e *Env) missingResolved() {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+
+	e.Status.Missing--
+	e.events.publish(EventMissing, MissingEvent{Missing: e.Status.Missing})
+}
+
+// Marks an export as running. Returns false if one is already running.
+func (e *Env) startExport() bool {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+
+	if e.Status.Export.Running {
+		return false
+	}
+	e.Status.Export.Running = true
+	e.events.publish(EventExportStarted, e.Status.Export)
+	return true
+}
+
+func (e *Env) finishExport(layers []*LayerExportStatus, err error) {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+
+	e.Status.Export.Layers = layers
+	e.Status.Export.Running = false
+	if err != nil {
+		e.Status.Export.Error = err.Error()
+		e.events.publish(EventExportFailed, e.Status.Export)
+	} else {
+		e.Status.Export.Error = ""
+		e.events.publish(EventExportFinished, e.Status.Export)
+	}
+}
+
+func (e *Env) handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribing along with the copy ensures no change gets lost in between
+	e.statusLock.Lock()
+	status := e.Status
+	events := e.events.subscribe()
+	e.statusLock.Unlock()
+	defer e.events.unsubscribe(events)
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry/time.Millisecond)
+	err = writeEvent(w, &Event{Type: EventStatus, Data: data})
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	end := time.After(eventsMaxDuration)
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, ev)
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case <-end:
+			return
+		case <-req.Context().Done():
+			return
+		case <-e.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
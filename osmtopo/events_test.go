@@ -0,0 +1,116 @@
+package osmtopo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cheekybits/is"
+)
+
+// Reads the next event from a stream, skipping comments and the retry hint
+func readEvent(r *bufio.Reader) (string, string, error) {
+	typ := ""
+	data := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimRight(line, "\n")
+
+		switch {
+		case line == "":
+			if typ != "" {
+				return typ, data, nil
+			}
+		case strings.HasPrefix(line, "event: "):
+			typ = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			data = line[6:]
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	env := &Env{ctx: ctx}
+	env.Status.Missing = 2
+
+	server := httptest.NewServer(http.HandlerFunc(env.handleEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.Header.Get("Content-Type"), "text/event-stream")
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	is.NoErr(err)
+	is.Equal(line, "retry: 5000\n")
+
+	typ, data, err := readEvent(r)
+	is.NoErr(err)
+	is.Equal(typ, EventStatus)
+	status := Status{}
+	is.NoErr(json.Unmarshal([]byte(data), &status))
+	is.Equal(status.Missing, 2)
+
+	env.setRunning(true)
+	env.missingResolved()
+	env.setMissing(1) // Unchanged, no event
+	env.setInitialized()
+	env.setInitialized()
+	env.publish(EventTopologyAdded, TopologyEvent{Layer: "countries", ID: 52411})
+	env.setRunning(false)
+
+	typ, _, err = readEvent(r)
+	is.NoErr(err)
+	is.Equal(typ, EventUpdaterStarted)
+
+	typ, data, err = readEvent(r)
+	is.NoErr(err)
+	is.Equal(typ, EventMissing)
+	is.Equal(data, `{"missing":1}`)
+
+	typ, _, err = readEvent(r)
+	is.NoErr(err)
+	is.Equal(typ, EventInitialized)
+
+	typ, data, err = readEvent(r)
+	is.NoErr(err)
+	is.Equal(typ, EventTopologyAdded)
+	is.Equal(data, `{"layer":"countries","id":52411}`)
+
+	typ, _, err = readEvent(r)
+	is.NoErr(err)
+	is.Equal(typ, EventUpdaterFinished)
+}
+
+func TestEventsSlowSubscriber(t *testing.T) {
+	is := is.New(t)
+
+	b := eventBroker{}
+	ch := b.subscribe()
+	for i := 0; i <= eventsBuffer; i++ {
+		b.publish(EventMissing, MissingEvent{Missing: i})
+	}
+
+	// Dropped once the buffer overflowed
+	n := 0
+	for range ch {
+		n++
+	}
+	is.Equal(n, eventsBuffer)
+	is.Equal(len(b.subscribers), 0)
+
+	b.unsubscribe(ch)
+}
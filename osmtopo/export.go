@@ -1,117 +1,595 @@
 package osmtopo
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 
-	geo "github.com/paulmach/go.geo"
+	"github.com/golang/geo/s2"
 	geojson "github.com/paulmach/go.geojson"
 	"github.com/rubenv/osmtopo/osmtopo/model"
 	"github.com/rubenv/topojson"
 )
 
-func (e *Env) export() error {
+type LayerExportStatus struct {
+	ID       string `json:"id"`
+	Features int    `json:"features"`
+	Slices   int    `json:"slices"`
+	Points   int    `json:"points"`
+	Changed  int    `json:"changed"`
+	Error    string `json:"error,omitempty"`
+}
+
+type exportSlice struct {
+	IDs []string
+
+	// Index of the slice in the previous export, -1 if new
+	Previous int
+
+	// Manifest entry of the previous export, if any
+	Manifest *SliceManifest
+
+	// Whether the slice needs to be written
+	Dirty bool
+}
+
+// Runs an export and waits for it to finish. Once initialized, all layers get
+// exported, even when some of them fail. Returns the status of each layer,
+// which is also available in Status.Export.
+func (e *Env) Export() ([]*LayerExportStatus, error) {
+	return e.runExport(false)
+}
+
+// Like Export, but reuses the clipped geometries of the previous export and
+// only rewrites the slices that contain relations that changed since then.
+// Unchanged slices are left untouched.
+func (e *Env) ExportIncremental() ([]*LayerExportStatus, error) {
+	return e.runExport(true)
+}
+
+// Returned when starting an export while another one is running, both would
+// write to the same output folder
+var ErrExportRunning = errors.New("Export is currently running")
+
+func (e *Env) runExport(incremental bool) ([]*LayerExportStatus, error) {
+	if !e.startExport() {
+		return nil, ErrExportRunning
+	}
+	return e.runStartedExport(incremental)
+}
+
+// Runs an export that was marked as running with startExport
+func (e *Env) runStartedExport(incremental bool) ([]*LayerExportStatus, error) {
+	e.done.Add(1)
+	defer e.done.Done()
+
+	layers, err := e.export(incremental)
+	e.finishExport(layers, err)
+	return layers, err
+}
+
+func (e *Env) export(incremental bool) ([]*LayerExportStatus, error) {
 	e.initialized.Wait()
 
 	err := os.MkdirAll(e.outputPath, 0755)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	result := make([]*LayerExportStatus, 0, len(e.config.Layers))
+	manifest := &Manifest{
+		Layers: make([]*ManifestLayer, 0, len(e.config.Layers)),
+	}
+	failed := make([]string, 0)
 	for _, layer := range e.config.Layers {
-		ids := e.topoData.Get(layer.ID)
-		contains := make(map[int64]bool)
-		for _, id := range ids {
-			contains[id] = true
+		if e.ctx.Err() != nil {
+			return result, e.ctx.Err()
+		}
+
+		status := &LayerExportStatus{
+			ID: layer.ID,
+		}
+		result = append(result, status)
+
+		err := e.exportLayer(layer, status, incremental)
+		if err != nil {
+			e.log("export", "Layer %s failed: %s", layer.ID, err)
+			status.Error = err.Error()
+			failed = append(failed, layer.ID)
+			manifest.Layers = append(manifest.Layers, &ManifestLayer{
+				ID:    layer.ID,
+				Name:  layer.Name,
+				Error: status.Error,
+			})
+			continue
+		}
+
+		manifest.Layers = append(manifest.Layers, &ManifestLayer{
+			ID:       layer.ID,
+			Name:     layer.Name,
+			Features: status.Features,
+			Slices:   status.Slices,
+			Manifest: path.Join(layer.ID, manifestFile),
+		})
+	}
+
+	err = writeManifest(e.outputPath, manifest)
+	if err != nil {
+		return result, err
+	}
+
+	if len(failed) > 0 {
+		return result, fmt.Errorf("Export failed for layers: %s", strings.Join(failed, ", "))
+	}
+	return result, nil
+}
+
+func (e *Env) exportLayer(layer Layer, status *LayerExportStatus, incremental bool) error {
+	formats, err := layer.OutputFormats()
+	if err != nil {
+		return err
+	}
+
+	folder := path.Join(e.outputPath, layer.ID)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	pipe := e.layerPipeline(layer, incremental)
+	topo, err := pipe.Run()
+	if err != nil {
+		return err
+	}
+	status.Features = len(topo.Objects)
+
+	manifest := &LayerManifest{
+		ID:     layer.ID,
+		Name:   layer.Name,
+		Slices: make([]*SliceManifest, 0),
+		Config: e.outputFingerprint(layer),
+	}
+
+	sliced := false
+	var features *geojson.FeatureCollection
+	for _, format := range formats {
+		if format == FormatTopoJSON {
+			sliced = true
+			continue
+		}
+
+		if features == nil {
+			features = topologyFeatures(topo)
 		}
 
-		err := os.MkdirAll(path.Join(e.outputPath, layer.ID), 0755)
+		filename := formatFilename(folder, layer, format)
+		err = writeFormat(filename, layer, format, features)
 		if err != nil {
 			return err
 		}
 
-		pipe := NewGeometryPipeline(e).
-			Filter(func(rel *model.Relation) bool {
-				return contains[rel.Id]
-			}).
-			Simplify(layer.Simplify).
-			ClipWater().
-			WithNames(e.config.Languages).
-			Quantize(1e6)
+		if manifest.Files == nil {
+			manifest.Files = make(map[string]string)
+		}
+		manifest.Files[format] = path.Base(filename)
+	}
 
-		topo, err := pipe.Run()
+	err = removeStaleFormats(folder, layer, formats)
+	if err != nil {
+		return err
+	}
+
+	staging := path.Join(folder, stagingFolder)
+	err = os.RemoveAll(staging)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if sliced {
+		err = e.exportSlices(folder, staging, topo, pipe, manifest, status, incremental)
 		if err != nil {
 			return err
 		}
+	}
 
-		centers := make(map[string][]float64)
-		for _, obj := range topo.Objects {
-			bb := obj.BoundingBox
-			centers[obj.ID] = []float64{
-				bb[0] + bb[2]/2,
-				bb[1] + bb[3]/2,
-			}
+	// The old manifest goes first: should the export get interrupted while
+	// swapping in the slices, the next one starts from scratch instead of
+	// trusting files that no longer match it.
+	err = os.Remove(path.Join(folder, manifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := range manifest.Slices {
+		err = os.Rename(sliceFilename(staging, i), sliceFilename(folder, i))
+		if err != nil {
+			return err
 		}
+	}
 
-		slice := 0
-		for len(centers) > 0 {
-			aggCenter := []float64{0, 0}
-			centerCount := 1
-
-			toSelect := []string{}
-			pointCount := 0
-
-			// Split into a number of files of approximately the same size (based on point count)
-			for pointCount < e.config.ExportPointLimit && len(centers) > 0 {
-				currCenter := geo.NewPointFromLatLng(aggCenter[1]/float64(centerCount), aggCenter[0]/float64(centerCount))
-
-				// Find closest topology
-				closestDist := math.MaxFloat64
-				key := ""
-				for k, center := range centers {
-					dist := currCenter.GeoDistanceFrom(geo.NewPointFromLatLng(center[1], center[0]))
-					if dist < closestDist {
-						key = k
-						closestDist = dist
-					}
-				}
-
-				// Update the aggregated center
-				center := centers[key]
-				aggCenter[0] += center[0]
-				aggCenter[1] += center[1]
-				centerCount += 1
-				delete(centers, key)
-
-				// Add it to the selection
-				toSelect = append(toSelect, key)
-				pointCount += countPoints(topo, topo.Objects[key])
-			}
+	err = removeStaleSlices(folder, len(manifest.Slices))
+	if err != nil {
+		return err
+	}
 
-			// Filter topology
-			filtered := topo.Filter(toSelect)
-			// Remove bounding boxes, not needed
-			for _, obj := range filtered.Objects {
-				obj.BoundingBox = nil
-			}
+	return writeManifest(folder, manifest)
+}
 
-			// Write it
-			fp, err := os.Create(path.Join(e.outputPath, layer.ID, fmt.Sprintf("%04d.topojson", slice)))
-			if err != nil {
+// Slices get written here, and only move into the layer folder once all of
+// them are done
+const stagingFolder = ".staging"
+
+// Fingerprint of the layer configuration that ends up in the exported
+// features or decides how they get sliced
+func (e *Env) outputFingerprint(layer Layer) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "simplify %d\n", layer.Simplify)
+	fmt.Fprintf(h, "languages %v\n", e.config.Languages)
+	fmt.Fprintf(h, "point limit %d\n", e.config.ExportPointLimit)
+	for _, prop := range layer.Properties {
+		fmt.Fprintf(h, "property %s %s\n", prop.Tag, prop.OutputName())
+	}
+	if len(layer.Filter) > 0 {
+		fmt.Fprintf(h, "filter %s\n", layer.Filter)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Pipeline that produces all features of a layer, clipped and simplified.
+// When reuseClipped is set, geometries clipped by an earlier run are reused.
+func (e *Env) layerPipeline(layer Layer, reuseClipped bool) *GeometryPipeline {
+	contains := make(map[int64]bool)
+	for _, id := range e.topoData.Get(layer.ID) {
+		contains[id] = true
+	}
+
+	return NewGeometryPipeline(e).
+		Filter(func(rel *model.Relation) bool {
+			return contains[rel.Id] && layer.Filter.MatchesRelation(rel)
+		}).
+		Simplify(layer.Simplify).
+		ClipWater().
+		CacheClipped(layer.ID, reuseClipped).
+		WithNames(e.config.Languages).
+		WithProperties(layer.Properties).
+		Quantize(1e6)
+}
+
+// Writes the TopoJSON slices of a layer to the staging folder, adding them to
+// the manifest. Unchanged slices of the previous export get linked in.
+func (e *Env) exportSlices(folder, staging string, topo *topojson.Topology, pipe *GeometryPipeline, manifest *LayerManifest, status *LayerExportStatus, incremental bool) error {
+	err := os.MkdirAll(staging, 0755)
+	if err != nil {
+		return err
+	}
+
+	var previous *LayerManifest
+	if incremental {
+		previous, err = readLayerManifest(folder)
+		if err != nil {
+			return err
+		}
+	}
+	if previous != nil && previous.Config != manifest.Config {
+		e.log("export", "Configuration of layer %s changed, writing all slices", manifest.ID)
+		previous = nil
+	}
+
+	var slices []*exportSlice
+	if previous == nil {
+		all := make([]string, 0, len(topo.Objects))
+		for id := range topo.Objects {
+			all = append(all, id)
+		}
+		for _, ids := range sliceObjects(topo, all, e.config.ExportPointLimit) {
+			slices = append(slices, &exportSlice{
+				IDs:      ids,
+				Previous: -1,
+				Dirty:    true,
+			})
+		}
+	} else {
+		changed := make(map[string]bool)
+		for _, id := range pipe.Clipped {
+			changed[fmt.Sprintf("%d", id)] = true
+		}
+		markArcNeighbours(topo, changed)
+		slices = updateSlices(previous, topo, changed, e.config.ExportPointLimit)
+	}
+
+	for i, slice := range slices {
+		filename := sliceFilename(staging, i)
+		if !slice.Dirty {
+			err = linkFile(sliceFilename(folder, slice.Previous), filename)
+			if os.IsNotExist(err) {
+				slice.Dirty = true
+			} else if err != nil {
 				return err
 			}
+		}
 
-			err = json.NewEncoder(fp).Encode(filtered)
+		if slice.Dirty {
+			err = writeSlice(filename, topo, slice.IDs)
 			if err != nil {
-				fp.Close()
 				return err
 			}
+			status.Changed += 1
+		}
+
+		// Unchanged slices keep describing the file as it was written
+		entry := slice.Manifest
+		if slice.Dirty || entry == nil {
+			entry = newSliceManifest(topo, i, slice.IDs)
+		}
+		entry.File = path.Base(filename)
+
+		status.Points += entry.Points
+		manifest.Slices = append(manifest.Slices, entry)
+	}
+	status.Slices = len(slices)
+
+	return nil
+}
+
+// Keeps the features of a previous export in their slice, appending new
+// slices for new features. Slices that lost or changed features are marked
+// dirty, empty slices are dropped.
+func updateSlices(previous *LayerManifest, topo *topojson.Topology, changed map[string]bool, pointLimit int) []*exportSlice {
+	result := make([]*exportSlice, 0, len(previous.Slices))
+	assigned := make(map[string]bool)
+	for i, entry := range previous.Slices {
+		ids := entry.IDs()
+		slice := &exportSlice{
+			IDs:      make([]string, 0, len(ids)),
+			Previous: i,
+			Manifest: entry,
+		}
+		for _, id := range ids {
+			if _, ok := topo.Objects[id]; !ok {
+				slice.Dirty = true
+				continue
+			}
+			if changed[id] {
+				slice.Dirty = true
+			}
+			assigned[id] = true
+			slice.IDs = append(slice.IDs, id)
+		}
+		if len(slice.IDs) > 0 {
+			result = append(result, slice)
+		}
+	}
+
+	added := make([]string, 0)
+	for id := range topo.Objects {
+		if !assigned[id] {
+			added = append(added, id)
+		}
+	}
+	for _, ids := range sliceObjects(topo, added, pointLimit) {
+		result = append(result, &exportSlice{
+			IDs:      ids,
+			Previous: -1,
+			Dirty:    true,
+		})
+	}
+
+	return result
+}
+
+// Marks the objects that share an arc with a changed object as changed too:
+// simplifying the topology can alter the shared borders of unchanged
+// neighbours.
+func markArcNeighbours(topo *topojson.Topology, changed map[string]bool) {
+	arcs := make(map[int]bool)
+	for id := range changed {
+		if obj, ok := topo.Objects[id]; ok {
+			geometryArcs(obj, arcs)
+		}
+	}
+	if len(arcs) == 0 {
+		return
+	}
+
+	neighbours := make([]string, 0)
+	for id, obj := range topo.Objects {
+		if changed[id] {
+			continue
+		}
+
+		used := make(map[int]bool)
+		geometryArcs(obj, used)
+		for arc := range used {
+			if arcs[arc] {
+				neighbours = append(neighbours, id)
+				break
+			}
+		}
+	}
+	for _, id := range neighbours {
+		changed[id] = true
+	}
+}
+
+// Collects the arcs used by a geometry
+func geometryArcs(obj *topojson.Geometry, arcs map[int]bool) {
+	add := func(list []int) {
+		for _, arc := range list {
+			if arc < 0 {
+				arc = ^arc
+			}
+			arcs[arc] = true
+		}
+	}
 
-			fp.Close()
-			slice += 1
+	switch obj.Type {
+	case geojson.GeometryLineString:
+		add(obj.LineString)
+	case geojson.GeometryMultiLineString:
+		for _, list := range obj.MultiLineString {
+			add(list)
+		}
+	case geojson.GeometryPolygon:
+		for _, list := range obj.Polygon {
+			add(list)
+		}
+	case geojson.GeometryMultiPolygon:
+		for _, poly := range obj.MultiPolygon {
+			for _, list := range poly {
+				add(list)
+			}
+		}
+	case geojson.GeometryCollection:
+		for _, geometry := range obj.Geometries {
+			geometryArcs(geometry, arcs)
+		}
+	}
+}
+
+// Splits the given objects into a number of slices of approximately the same
+// size (based on point count).
+//
+// Objects are ordered along the S2 (Hilbert) curve through their centers, so
+// nearby objects end up in the same slice. Ties are broken by ID, which makes
+// the result independent of the order of the input.
+func sliceObjects(topo *topojson.Topology, ids []string, pointLimit int) [][]string {
+	order := make(sliceOrder, 0, len(ids))
+	for _, id := range ids {
+		bb := topo.Objects[id].BoundingBox
+		center := s2.LatLngFromDegrees((bb[1]+bb[3])/2, (bb[0]+bb[2])/2)
+		order = append(order, sliceEntry{
+			ID:   id,
+			Cell: s2.CellIDFromLatLng(center),
+		})
+	}
+	sort.Sort(order)
+
+	result := make([][]string, 0)
+	toSelect := []string{}
+	pointCount := 0
+	for _, entry := range order {
+		toSelect = append(toSelect, entry.ID)
+		pointCount += countPoints(topo, topo.Objects[entry.ID])
+
+		if pointCount >= pointLimit {
+			result = append(result, toSelect)
+			toSelect = []string{}
+			pointCount = 0
+		}
+	}
+	if len(toSelect) > 0 {
+		result = append(result, toSelect)
+	}
+
+	return result
+}
+
+type sliceEntry struct {
+	ID   string
+	Cell s2.CellID
+}
+
+type sliceOrder []sliceEntry
+
+func (s sliceOrder) Len() int      { return len(s) }
+func (s sliceOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sliceOrder) Less(i, j int) bool {
+	if s[i].Cell != s[j].Cell {
+		return s[i].Cell < s[j].Cell
+	}
+
+	// Numeric IDs sort numerically
+	a, errA := strconv.ParseInt(s[i].ID, 10, 64)
+	b, errB := strconv.ParseInt(s[j].ID, 10, 64)
+	if errA == nil && errB == nil {
+		return a < b
+	}
+	return s[i].ID < s[j].ID
+}
+
+func sliceFilename(folder string, slice int) string {
+	return path.Join(folder, fmt.Sprintf("%04d.topojson", slice))
+}
+
+func writeSlice(filename string, topo *topojson.Topology, ids []string) error {
+	// Filter topology
+	filtered := topo.Filter(ids)
+	// Remove bounding boxes, not needed
+	for _, obj := range filtered.Objects {
+		obj.BoundingBox = nil
+	}
+
+	// Write it
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fp).Encode(filtered)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	return fp.Close()
+}
+
+// Hard links a file, copying it when that's not possible
+func linkFile(from, to string) error {
+	err := os.Link(from, to)
+	if err == nil || os.IsNotExist(err) {
+		return err
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Removes slices left behind by a previous export that had more slices
+func removeStaleSlices(folder string, count int) error {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".topojson") {
+			continue
+		}
+
+		slice, err := strconv.Atoi(strings.TrimSuffix(name, ".topojson"))
+		if err != nil || slice < count {
+			continue
+		}
+
+		err = os.Remove(path.Join(folder, name))
+		if err != nil {
+			return err
 		}
 	}
 	return nil
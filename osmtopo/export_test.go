@@ -1,46 +1,38 @@
 package osmtopo
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/cheekybits/is"
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/rubenv/osmtopo/osmtopo/model"
+	"github.com/rubenv/topojson"
 )
 
-func TestExport(t *testing.T) {
-	is := is.New(t)
-
-	folder, err := ioutil.TempDir("", "test")
-	is.NoErr(err)
-	defer os.RemoveAll(folder)
-
+// Environment with the Isle of Man imported, along with a selection of its
+// countries, regions and cities. The Isle of Man is ideal: small file size,
+// water, regional subdivisions.
+func newExportEnv(is is.I, folder string, layers []Layer) (*Env, *Config, string) {
 	config := NewConfig()
 	config.Water = "fixtures/geodata/water-cropped.zip"
 	config.Sources = map[string]PBFSource{
-		// The Isle of Man is ideal: small file size, water, regional subdivisions
 		"man": PBFSource{
 			Seed: "fixtures/geodata/isle-of-man-latest.osm.pbf",
 		},
 	}
-	config.Layers = []Layer{
-		{
-			ID:       "countries",
-			Name:     "Countries",
-			Simplify: 3,
-		},
-		{
-			ID:       "regions",
-			Name:     "Regions",
-			Simplify: 5,
-		},
-		{
-			ID:       "cities",
-			Name:     "Cities",
-			Simplify: 6,
-		},
-	}
+	config.Layers = layers
 	config.ExportPointLimit = 1000
 	config.Languages = []string{"en", "nl", "fr"}
 
@@ -69,15 +61,47 @@ func TestExport(t *testing.T) {
 			},
 		},
 	}
-	err = topologies.WriteTo(topologiesFile)
+	err := topologies.WriteTo(topologiesFile)
 	is.NoErr(err)
 
 	env, err := NewEnv(config, topologiesFile, storePath, outputPath)
 	is.NoErr(err)
 	is.NotNil(env)
+	return env, config, outputPath
+}
+
+// Countries, regions and cities of the Isle of Man
+func exportLayers() []Layer {
+	return []Layer{
+		{
+			ID:       "countries",
+			Name:     "Countries",
+			Simplify: 3,
+		},
+		{
+			ID:       "regions",
+			Name:     "Regions",
+			Simplify: 5,
+		},
+		{
+			ID:       "cities",
+			Name:     "Cities",
+			Simplify: 6,
+		},
+	}
+}
+
+func TestExport(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, _, outputPath := newExportEnv(is, folder, exportLayers())
 	defer env.Stop()
 
-	err = env.export()
+	_, err = env.export(false)
 	is.NoErr(err)
 
 	isFile(is, path.Join(outputPath, "countries/0000.topojson"))
@@ -86,6 +110,628 @@ func TestExport(t *testing.T) {
 	isFile(is, path.Join(outputPath, "cities/0001.topojson"))
 }
 
+func TestExportProperties(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, _, outputPath := newExportEnv(is, folder, []Layer{
+		{
+			ID:         "countries",
+			Name:       "Countries",
+			Simplify:   3,
+			Properties: []Property{{Tag: "ISO3166-1", Name: "iso"}},
+		},
+	})
+	defer env.Stop()
+
+	_, err = env.export(false)
+	is.NoErr(err)
+
+	// Configured tags are kept when importing and exported as properties
+	rel, err := env.GetRelation(62269)
+	is.NoErr(err)
+	iso, ok := rel.GetTag("ISO3166-1")
+	is.True(ok)
+	is.Equal(iso, "IM")
+	_, ok = rel.GetTag("wikidata")
+	is.False(ok)
+
+	countries := &topojson.Topology{}
+	readJSON(is, path.Join(outputPath, "countries/0000.topojson"), countries)
+	is.Equal(countries.Objects["62269"].Properties["iso"], "IM")
+	_, ok = countries.Objects["62269"].Properties["ISO3166-1"]
+	is.False(ok)
+}
+
+func TestExportManifest(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, _, outputPath := newExportEnv(is, folder, exportLayers())
+	defer env.Stop()
+
+	layers, err := env.export(false)
+	is.NoErr(err)
+	is.Equal(len(layers), 3)
+	for _, layer := range layers {
+		is.Equal(layer.Error, "")
+		is.True(layer.Features > 0)
+		is.True(layer.Points > 0)
+		is.Equal(layer.Changed, layer.Slices)
+	}
+	is.Equal(layers[2].Slices, 2)
+
+	// Manifests describe all layers and slices
+	isFile(is, path.Join(outputPath, "manifest.json"))
+	index := &Manifest{}
+	readJSON(is, path.Join(outputPath, "manifest.json"), index)
+	is.Equal(len(index.Layers), 3)
+	is.Equal(index.Layers[2].ID, "cities")
+	is.Equal(index.Layers[2].Slices, 2)
+	is.Equal(index.Layers[2].Manifest, "cities/manifest.json")
+
+	cities := &LayerManifest{}
+	readJSON(is, path.Join(outputPath, "cities/manifest.json"), cities)
+	is.Equal(len(cities.Slices), 2)
+	is.Equal(cities.Slices[0].File, "0000.topojson")
+	is.Equal(cities.Slices[1].File, "0001.topojson")
+	features := 0
+	for _, slice := range cities.Slices {
+		is.True(slice.Points > 0)
+		is.Equal(len(slice.BoundingBox), 4)
+		is.True(slice.BoundingBox[0] < slice.BoundingBox[2])
+		is.True(slice.BoundingBox[1] < slice.BoundingBox[3])
+		for _, feature := range slice.Features {
+			is.NotEqual(feature.Name, "")
+			features++
+		}
+	}
+	is.Equal(features, layers[2].Features)
+	is.Equal(len(cities.Files), 0)
+}
+
+func TestExportDeterministic(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, _, outputPath := newExportEnv(is, folder, exportLayers())
+	defer env.Stop()
+
+	_, err = env.export(false)
+	is.NoErr(err)
+	first := readSlices(is, outputPath)
+
+	// Exporting identical input gives identical output
+	_, err = env.export(false)
+	is.NoErr(err)
+	is.Equal(readSlices(is, outputPath), first)
+}
+
+func TestExportIncremental(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, config, outputPath := newExportEnv(is, folder, exportLayers())
+	defer env.Stop()
+
+	_, err = env.export(false)
+	is.NoErr(err)
+	first := readSlices(is, outputPath)
+
+	// Nothing changed: nothing gets rewritten
+	layers, err := env.export(true)
+	is.NoErr(err)
+	for _, layer := range layers {
+		is.Equal(layer.Error, "")
+		is.Equal(layer.Changed, 0)
+	}
+	is.Equal(readSlices(is, outputPath), first)
+
+	// A changed city only affects the slice it is in and those of the
+	// cities it shares a border with
+	citiesPath := path.Join(outputPath, "cities")
+	manifest, err := readLayerManifest(citiesPath)
+	is.NoErr(err)
+	is.Equal(len(manifest.Slices), 2)
+	changed := manifest.Slices[1].Features[0].ID
+
+	topo, err := env.layerPipeline(config.Layers[2], true).Run()
+	is.NoErr(err)
+	arcs := make(map[int]bool)
+	geometryArcs(topo.Objects[changed], arcs)
+	affected := map[string]bool{changed: true}
+	for id, obj := range topo.Objects {
+		used := make(map[int]bool)
+		geometryArcs(obj, used)
+		for arc := range used {
+			if arcs[arc] {
+				affected[id] = true
+			}
+		}
+	}
+	is.True(len(affected) > 1)
+
+	expected := make(map[string]bool)
+	before := make(map[string]os.FileInfo)
+	for _, slice := range manifest.Slices {
+		for _, feature := range slice.Features {
+			if affected[feature.ID] {
+				expected[slice.File] = true
+			}
+		}
+		fi, err := os.Stat(path.Join(citiesPath, slice.File))
+		is.NoErr(err)
+		before[slice.File] = fi
+	}
+
+	id, err := strconv.ParseInt(changed, 10, 64)
+	is.NoErr(err)
+	is.NoErr(env.removeDerived([]int64{id}))
+
+	layers, err = env.export(true)
+	is.NoErr(err)
+	is.Equal(layers[0].Changed, 0)
+	is.Equal(layers[1].Changed, 0)
+	is.Equal(layers[2].Changed, len(expected))
+	is.Equal(layers[2].Slices, 2)
+
+	// Unchanged slices are linked in, rewritten ones are new files
+	rewritten := make(map[string]bool)
+	for file, fi := range before {
+		after, err := os.Stat(path.Join(citiesPath, file))
+		is.NoErr(err)
+		if !os.SameFile(fi, after) {
+			rewritten[file] = true
+		}
+	}
+	is.Equal(rewritten, expected)
+
+	// Its geometry didn't really change, neither do the slices
+	is.Equal(readSlices(is, outputPath), first)
+
+	// Changing what ends up in the features rewrites all slices
+	config.Languages = []string{"en", "de"}
+	layers, err = env.export(true)
+	is.NoErr(err)
+	for _, layer := range layers {
+		is.Equal(layer.Error, "")
+		is.Equal(layer.Changed, layer.Slices)
+	}
+	_, err = os.Stat(path.Join(citiesPath, stagingFolder))
+	is.True(os.IsNotExist(err))
+
+	// So does a different slice size
+	config.ExportPointLimit = 500
+	layers, err = env.export(true)
+	is.NoErr(err)
+	for _, layer := range layers {
+		is.Equal(layer.Error, "")
+		is.Equal(layer.Changed, layer.Slices)
+	}
+}
+
+func TestExportIncrementalBorder(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, _, outputPath := newExportEnv(is, folder, []Layer{
+		{
+			ID:       "regions",
+			Name:     "Regions",
+			Simplify: 5,
+		},
+	})
+	defer env.Stop()
+
+	_, err = env.export(false)
+	is.NoErr(err)
+
+	// Move a vertex on the border of Rushen, without touching its
+	// neighbours
+	rushen := int64(1061135)
+	border := make(map[[2]float64]bool)
+	for _, id := range []int64{1061147, 1061146} { // Glenfaba, Middle
+		for _, ring := range polygonRings(is, cachedGeometry(is, env, id)) {
+			for _, c := range ring {
+				border[[2]float64{c[0], c[1]}] = true
+			}
+		}
+	}
+	onBorder := func(c []float64) bool {
+		return border[[2]float64{c[0], c[1]}]
+	}
+
+	moved := false
+	geom := cachedGeometry(is, env, rushen)
+	for _, ring := range polygonRings(is, geom) {
+		for i := 1; i < len(ring)-1 && !moved; i++ {
+			if onBorder(ring[i-1]) && onBorder(ring[i]) && onBorder(ring[i+1]) {
+				ring[i][0] += 0.001
+				ring[i][1] += 0.001
+				moved = true
+			}
+		}
+	}
+	is.True(moved)
+
+	data, err := json.Marshal(geom)
+	is.NoErr(err)
+	is.NoErr(env.removeDerived([]int64{rushen}))
+	is.NoErr(env.addGeometry("rel", &model.Geometry{
+		Id:      rushen,
+		Geojson: data,
+	}))
+
+	layers, err := env.export(true)
+	is.NoErr(err)
+	is.True(layers[0].Changed > 0)
+	incremental := readFeatures(is, path.Join(outputPath, "regions"))
+
+	// Gives the same features as a full export
+	env.outputPath = path.Join(folder, "full")
+	_, err = env.export(false)
+	is.NoErr(err)
+	full := readFeatures(is, path.Join(env.outputPath, "regions"))
+	is.True(len(incremental) > 0)
+	is.Equal(incremental, full)
+}
+
+// Loads the cached (unclipped) geometry of a relation
+func cachedGeometry(is is.I, env *Env, id int64) *geojson.Geometry {
+	cached, err := env.GetGeometry("rel", id)
+	is.NoErr(err)
+	is.NotNil(cached)
+
+	geom := &geojson.Geometry{}
+	is.NoErr(json.Unmarshal(cached.Geojson, geom))
+	return geom
+}
+
+// Rings of a (multi)polygon, changing them changes the geometry
+func polygonRings(is is.I, geom *geojson.Geometry) [][][]float64 {
+	switch {
+	case geom.IsPolygon():
+		return geom.Polygon
+	case geom.IsMultiPolygon():
+		rings := make([][][]float64, 0)
+		for _, poly := range geom.MultiPolygon {
+			rings = append(rings, poly...)
+		}
+		return rings
+	}
+	is.Fail("Unexpected geometry type: ", geom.Type)
+	return nil
+}
+
+// Reads the geometries of all features in the slices of a layer
+func readFeatures(is is.I, folder string) map[string]string {
+	manifest, err := readLayerManifest(folder)
+	is.NoErr(err)
+
+	result := make(map[string]string)
+	for _, slice := range manifest.Slices {
+		topo := &topojson.Topology{}
+		readJSON(is, path.Join(folder, slice.File), topo)
+		for id := range topo.Objects {
+			fc := topo.Filter([]string{id}).ToGeoJSON()
+			is.Equal(len(fc.Features), 1)
+			data, err := json.Marshal(fc.Features[0].Geometry)
+			is.NoErr(err)
+			result[id] = string(data)
+		}
+	}
+	return result
+}
+
+func TestRemoveClippedGeometries(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, err := prepareEnv(NewConfig(), path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	// Caches of an earlier simplification and of a removed layer
+	prefixes := []string{clipPrefix("regions", 5), clipPrefix("regions", 50), clipPrefix("old", 3)}
+	for _, prefix := range prefixes {
+		for _, id := range []int64{1, 2} {
+			is.NoErr(env.addGeometry(prefix, &model.Geometry{Id: id}))
+		}
+	}
+	stored, err := env.clipPrefixes()
+	is.NoErr(err)
+	sort.Strings(stored)
+	sort.Strings(prefixes)
+	is.Equal(stored, prefixes)
+
+	is.NoErr(env.removeDerived([]int64{1}))
+	for _, prefix := range prefixes {
+		ids, err := env.GetGeometries(prefix)
+		is.NoErr(err)
+		is.Equal(ids, []int64{2})
+	}
+
+	is.NoErr(env.removeClippedGeometries())
+	stored, err = env.clipPrefixes()
+	is.NoErr(err)
+	is.Equal(len(stored), 0)
+}
+
+func TestExportFormats(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, _, outputPath := newExportEnv(is, folder, []Layer{
+		{
+			ID:       "regions",
+			Name:     "Regions",
+			Simplify: 5,
+			Formats:  []string{"topojson", "geojson", "ndjson", "flatgeobuf", "shapefile"},
+		},
+	})
+	defer env.Stop()
+
+	layers, err := env.export(false)
+	is.NoErr(err)
+	is.Equal(layers[0].Error, "")
+	isFile(is, path.Join(outputPath, "regions/0000.topojson"))
+
+	// Other formats contain all features in a single file
+	isFile(is, path.Join(outputPath, "regions/regions.fgb"))
+	isFile(is, path.Join(outputPath, "regions/regions.shp"))
+	isFile(is, path.Join(outputPath, "regions/regions.dbf"))
+	fc := geojson.NewFeatureCollection()
+	readJSON(is, path.Join(outputPath, "regions/regions.geojson"), fc)
+	is.Equal(len(fc.Features), layers[0].Features)
+	data, err := ioutil.ReadFile(path.Join(outputPath, "regions/regions.ndjson"))
+	is.NoErr(err)
+	is.Equal(strings.Count(string(data), "\n"), layers[0].Features)
+
+	regions := &LayerManifest{}
+	readJSON(is, path.Join(outputPath, "regions/manifest.json"), regions)
+	is.Equal(regions.Files["geojson"], "regions.geojson")
+	is.Equal(regions.Files["ndjson"], "regions.ndjson")
+	is.Equal(regions.Files["flatgeobuf"], "regions.fgb")
+	is.Equal(regions.Files["shapefile"], "regions.shp")
+
+	// Dropped formats get cleaned up
+	env.config.Layers[0].Formats = []string{"topojson"}
+	_, err = env.export(false)
+	is.NoErr(err)
+	_, err = os.Stat(path.Join(outputPath, "regions/regions.geojson"))
+	is.True(os.IsNotExist(err))
+}
+
+func TestExportTiles(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, _, outputPath := newExportEnv(is, folder, []Layer{
+		{
+			ID:       "countries",
+			Name:     "Countries",
+			Simplify: 3,
+			Formats:  []string{"topojson", "mvt", "mbtiles"},
+			MinZoom:  6,
+			MaxZoom:  8,
+		},
+	})
+	defer env.Stop()
+
+	layers, err := env.export(false)
+	is.NoErr(err)
+	is.Equal(layers[0].Error, "")
+
+	// The Isle of Man is covered by a single tile at zoom 6
+	isFile(is, path.Join(outputPath, "countries/tiles/6/31/20.pbf"))
+	isFile(is, path.Join(outputPath, "countries/countries.mbtiles"))
+	_, err = os.Stat(path.Join(outputPath, "countries/tiles/5"))
+	is.True(os.IsNotExist(err))
+	_, err = os.Stat(path.Join(outputPath, "countries/tiles/9"))
+	is.True(os.IsNotExist(err))
+}
+
+func TestTilesAddTopology(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, config, _ := newExportEnv(is, folder, []Layer{
+		{
+			ID:       "regions",
+			Name:     "Regions",
+			Simplify: 5,
+			MinZoom:  6,
+			MaxZoom:  8,
+		},
+	})
+	defer env.Stop()
+	env.initialized.Wait()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/add", http.HandlerFunc(env.handleAdd))
+	mux.Handle("/api/tiles/", http.HandlerFunc(env.handleTiles))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	getTile := func() []byte {
+		resp, err := http.Get(server.URL + "/api/tiles/regions/6/31/20.pbf")
+		is.NoErr(err)
+		defer resp.Body.Close()
+		is.Equal(resp.StatusCode, http.StatusOK)
+		data, err := ioutil.ReadAll(resp.Body)
+		is.NoErr(err)
+		return data
+	}
+
+	layer := config.GetLayer("regions")
+	before := getTile()
+	fc, err := env.getLayerFeatures(layer)
+	is.NoErr(err)
+	regions := len(fc.Features)
+
+	// Adding a topology drops the cached tile features
+	resp, err := http.Post(server.URL+"/api/add", "application/json", strings.NewReader(`{"regions": 62269}`))
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	after := getTile()
+	is.NotEqual(string(after), string(before))
+	fc, err = env.getLayerFeatures(layer)
+	is.NoErr(err)
+	is.Equal(len(fc.Features), regions+1)
+}
+
+func TestExportFailedLayer(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	config := NewConfig()
+	config.Layers = []Layer{
+		{
+			ID:      "countries",
+			Name:    "Countries",
+			Formats: []string{"kml"},
+		},
+	}
+
+	topologiesFile := path.Join(folder, "topo.yaml")
+	outputPath := path.Join(folder, "output")
+	err = (&TopologyData{Layers: map[string]IDSlice{}}).WriteTo(topologiesFile)
+	is.NoErr(err)
+
+	env, err := OpenEnv(config, topologiesFile, path.Join(folder, "store"), outputPath)
+	is.NoErr(err)
+	defer env.Stop()
+
+	layers, err := env.export(false)
+	is.Err(err)
+	is.NotEqual(layers[0].Error, "")
+
+	// Failed layers are listed, so clients can tell them from removed ones
+	index := &Manifest{}
+	readJSON(is, path.Join(outputPath, "manifest.json"), index)
+	is.Equal(len(index.Layers), 1)
+	is.Equal(index.Layers[0].ID, "countries")
+	is.Equal(index.Layers[0].Error, layers[0].Error)
+	is.Equal(index.Layers[0].Manifest, "")
+}
+
+func TestExportRunning(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	env := &Env{ctx: ctx}
+	is.True(env.startExport())
+
+	// Only one export can run at a time
+	_, err := env.Export()
+	is.Equal(err, ErrExportRunning)
+
+	server := httptest.NewServer(http.HandlerFunc(env.handleExport))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "", nil)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+	is.True(env.status().Export.Running)
+}
+
+func TestSliceObjectsStable(t *testing.T) {
+	is := is.New(t)
+
+	topo := &topojson.Topology{
+		Objects: make(map[string]*topojson.Geometry),
+	}
+	ids := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("%d", 1000+i)
+		lon := float64(i%7) * 0.1
+		lat := float64(i%5) * 0.1
+		topo.Objects[id] = &topojson.Geometry{
+			ID:          id,
+			Type:        geojson.GeometryPoint,
+			Point:       []float64{lon, lat},
+			BoundingBox: []float64{lon, lat, lon, lat},
+		}
+		ids = append(ids, id)
+	}
+
+	expected := sliceObjects(topo, ids, 10)
+	is.Equal(len(expected), 5)
+	for _, slice := range expected {
+		is.Equal(len(slice), 10)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		r.Shuffle(len(ids), func(i, j int) {
+			ids[i], ids[j] = ids[j], ids[i]
+		})
+		is.Equal(sliceObjects(topo, ids, 10), expected)
+	}
+}
+
+func readJSON(is is.I, filename string, v interface{}) {
+	fp, err := os.Open(filename)
+	is.NoErr(err)
+	defer fp.Close()
+	is.NoErr(json.NewDecoder(fp).Decode(v))
+}
+
+// Reads all exported slices, keyed by layer and filename
+func readSlices(is is.I, outputPath string) map[string]string {
+	result := make(map[string]string)
+	layers, err := ioutil.ReadDir(outputPath)
+	is.NoErr(err)
+	for _, layer := range layers {
+		files, err := ioutil.ReadDir(path.Join(outputPath, layer.Name()))
+		is.NoErr(err)
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".topojson") {
+				continue
+			}
+			name := path.Join(layer.Name(), file.Name())
+			data, err := ioutil.ReadFile(path.Join(outputPath, name))
+			is.NoErr(err)
+			result[name] = string(data)
+		}
+	}
+	return result
+}
+
 func isFile(is is.I, path string) {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
@@ -0,0 +1,192 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rubenv/osmtopo/osmtopo/model"
+)
+
+// Selects relations by their tags. A filter is a list of expressions, all of
+// which need to match:
+//
+//	key          the tag is present
+//	!key         the tag is absent
+//	key=a|b      the tag has one of the values
+//	key!=a|b     the tag is present, but has none of the values
+//
+// An empty filter matches everything.
+type TagFilter []TagExpr
+
+type TagExpr struct {
+	Key    string
+	Values []string
+	Negate bool
+}
+
+// Parses a list of filter expressions
+func ParseTagFilter(exprs ...string) (TagFilter, error) {
+	result := make(TagFilter, 0, len(exprs))
+	for _, expr := range exprs {
+		e, err := parseTagExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+func parseTagExpr(expr string) (TagExpr, error) {
+	s := strings.TrimSpace(expr)
+	e := TagExpr{}
+
+	if strings.HasPrefix(s, "!") && !strings.Contains(s, "=") {
+		e.Key = strings.TrimSpace(s[1:])
+		e.Negate = true
+	} else if i := strings.Index(s, "!="); i >= 0 {
+		e.Key = strings.TrimSpace(s[:i])
+		e.Values = splitValues(s[i+2:])
+		e.Negate = true
+	} else if i := strings.Index(s, "="); i >= 0 {
+		e.Key = strings.TrimSpace(s[:i])
+		e.Values = splitValues(s[i+1:])
+	} else {
+		e.Key = s
+	}
+
+	if e.Key == "" || strings.ContainsAny(e.Key, "!=|") {
+		return e, fmt.Errorf("Invalid filter expression: %q", expr)
+	}
+	for _, v := range e.Values {
+		if v == "" {
+			return e, fmt.Errorf("Invalid filter expression: %q", expr)
+		}
+	}
+	return e, nil
+}
+
+func splitValues(s string) []string {
+	values := strings.Split(s, "|")
+	for i, v := range values {
+		values[i] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+func (f *TagFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var exprs []string
+	err := unmarshal(&exprs)
+	if err != nil {
+		// Allow a single expression as well
+		var expr string
+		if unmarshal(&expr) != nil {
+			return err
+		}
+		exprs = []string{expr}
+	}
+
+	filter, err := ParseTagFilter(exprs...)
+	if err != nil {
+		return err
+	}
+	*f = filter
+	return nil
+}
+
+// Filters are written as their expressions in JSON too, the way they are
+// configured
+func (f TagFilter) MarshalJSON() ([]byte, error) {
+	exprs := make([]string, len(f))
+	for i, e := range f {
+		exprs[i] = e.String()
+	}
+	return json.Marshal(exprs)
+}
+
+func (f *TagFilter) UnmarshalJSON(data []byte) error {
+	var exprs []string
+	err := json.Unmarshal(data, &exprs)
+	if err != nil {
+		return err
+	}
+
+	filter, err := ParseTagFilter(exprs...)
+	if err != nil {
+		return err
+	}
+	*f = filter
+	return nil
+}
+
+func (f TagFilter) String() string {
+	exprs := make([]string, len(f))
+	for i, e := range f {
+		exprs[i] = e.String()
+	}
+	return strings.Join(exprs, " ")
+}
+
+func (e TagExpr) String() string {
+	switch {
+	case len(e.Values) == 0 && e.Negate:
+		return "!" + e.Key
+	case len(e.Values) == 0:
+		return e.Key
+	case e.Negate:
+		return e.Key + "!=" + strings.Join(e.Values, "|")
+	default:
+		return e.Key + "=" + strings.Join(e.Values, "|")
+	}
+}
+
+// Tag keys used by the filter
+func (f TagFilter) Keys() []string {
+	keys := make([]string, len(f))
+	for i, e := range f {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+// Checks a map of tags, as found in OSM elements
+func (f TagFilter) MatchesTags(tags map[string]string) bool {
+	return f.matches(func(k string) (string, bool) {
+		v, ok := tags[k]
+		return v, ok
+	})
+}
+
+// Checks the (stored) tags of a relation
+func (f TagFilter) MatchesRelation(rel *model.Relation) bool {
+	return f.matches(rel.GetTag)
+}
+
+func (f TagFilter) matches(getTag func(k string) (string, bool)) bool {
+	for _, e := range f {
+		v, ok := getTag(e.Key)
+		if !e.matches(v, ok) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e TagExpr) matches(v string, present bool) bool {
+	if len(e.Values) == 0 {
+		return present != e.Negate
+	}
+	if !present {
+		return false
+	}
+
+	found := false
+	for _, value := range e.Values {
+		if v == value {
+			found = true
+			break
+		}
+	}
+	return found != e.Negate
+}
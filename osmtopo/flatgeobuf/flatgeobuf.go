@@ -0,0 +1,391 @@
+// Package flatgeobuf writes FlatGeobuf files (https://flatgeobuf.org/).
+//
+// A FlatGeobuf file consists of a magic number, a header, a packed Hilbert
+// R-tree spatial index and the features, which are ordered along the Hilbert
+// curve. The header and the features are FlatBuffers tables.
+package flatgeobuf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	geojson "github.com/paulmach/go.geojson"
+)
+
+var magic = []byte{'f', 'g', 'b', 3, 'f', 'g', 'b', 0}
+
+// Number of children of each node in the spatial index
+const NodeSize = 16
+
+type geometryType byte
+
+const (
+	geometryUnknown      geometryType = 0
+	geometryPolygon      geometryType = 3
+	geometryMultiPolygon geometryType = 6
+)
+
+type ColumnType byte
+
+const (
+	ColumnBool   ColumnType = 2
+	ColumnLong   ColumnType = 7
+	ColumnDouble ColumnType = 10
+	ColumnString ColumnType = 11
+)
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+type feature struct {
+	Geometry   *geojson.Geometry
+	Properties map[string]interface{}
+	Bounds     node
+}
+
+// Writes the features as a FlatGeobuf file, with a spatial index. Only
+// (multi)polygons are supported. The columns are derived from the properties
+// of the features.
+func Write(w io.Writer, name string, fc *geojson.FeatureCollection) error {
+	columns, err := columnsOf(fc)
+	if err != nil {
+		return err
+	}
+
+	features := make([]*feature, 0, len(fc.Features))
+	gtype := geometryUnknown
+	extent := emptyNode()
+	for i, f := range fc.Features {
+		t, err := typeOf(f.Geometry)
+		if err != nil {
+			return fmt.Errorf("Feature %d: %s", i, err)
+		}
+		if i == 0 {
+			gtype = t
+		} else if gtype != t {
+			gtype = geometryUnknown
+		}
+
+		bounds := emptyNode()
+		switch t {
+		case geometryPolygon:
+			bounds.expandRings(f.Geometry.Polygon)
+		case geometryMultiPolygon:
+			for _, poly := range f.Geometry.MultiPolygon {
+				bounds.expandRings(poly)
+			}
+		}
+		extent.expand(bounds)
+
+		features = append(features, &feature{
+			Geometry:   f.Geometry,
+			Properties: f.Properties,
+			Bounds:     bounds,
+		})
+	}
+	hilbertSort(features, extent)
+
+	// Encode the features first: the index needs their offsets
+	encoded := make([][]byte, len(features))
+	leaves := make([]node, len(features))
+	offset := uint64(0)
+	for i, f := range features {
+		data, err := encodeFeature(f, columns, gtype)
+		if err != nil {
+			return err
+		}
+		encoded[i] = data
+		leaves[i] = f.Bounds
+		leaves[i].Offset = offset
+		offset += uint64(4 + len(data))
+	}
+
+	nodeSize := uint16(NodeSize)
+	var envelope []float64
+	if len(features) > 0 {
+		envelope = []float64{extent.MinX, extent.MinY, extent.MaxX, extent.MaxY}
+	} else {
+		nodeSize = 0
+	}
+
+	bw := bufio.NewWriter(w)
+	_, err = bw.Write(magic)
+	if err != nil {
+		return err
+	}
+
+	err = writeSizePrefixed(bw, encodeHeader(name, envelope, gtype, columns, uint64(len(features)), nodeSize))
+	if err != nil {
+		return err
+	}
+
+	if nodeSize > 0 {
+		err = writeIndex(bw, leaves, nodeSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, data := range encoded {
+		err = writeSizePrefixed(bw, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeSizePrefixed(w io.Writer, data []byte) error {
+	err := binary.Write(w, binary.LittleEndian, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func typeOf(g *geojson.Geometry) (geometryType, error) {
+	if g == nil {
+		return geometryUnknown, fmt.Errorf("Missing geometry")
+	}
+
+	switch g.Type {
+	case geojson.GeometryPolygon:
+		return geometryPolygon, nil
+	case geojson.GeometryMultiPolygon:
+		return geometryMultiPolygon, nil
+	default:
+		return geometryUnknown, fmt.Errorf("Unsupported geometry type: %s", g.Type)
+	}
+}
+
+// Collects the columns used by the features, ordered by name
+func columnsOf(fc *geojson.FeatureCollection) ([]Column, error) {
+	types := make(map[string]ColumnType)
+	for _, f := range fc.Features {
+		for k, v := range f.Properties {
+			var t ColumnType
+			switch v.(type) {
+			case nil:
+				continue
+			case string:
+				t = ColumnString
+			case float64, float32:
+				t = ColumnDouble
+			case int, int64, int32:
+				t = ColumnLong
+			case bool:
+				t = ColumnBool
+			default:
+				return nil, fmt.Errorf("Unsupported value for property %s: %T", k, v)
+			}
+
+			if existing, ok := types[k]; ok && existing != t {
+				return nil, fmt.Errorf("Property %s has mixed types", k)
+			}
+			types[k] = t
+		}
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	columns := make([]Column, len(names))
+	for i, name := range names {
+		columns[i] = Column{Name: name, Type: types[name]}
+	}
+	return columns, nil
+}
+
+func encodeHeader(name string, envelope []float64, gtype geometryType, columns []Column, count uint64, nodeSize uint16) []byte {
+	b := flatbuffers.NewBuilder(1024)
+
+	nameOff := b.CreateString(name)
+
+	var envelopeOff flatbuffers.UOffsetT
+	if envelope != nil {
+		envelopeOff = createFloat64Vector(b, envelope)
+	}
+
+	var columnsOff flatbuffers.UOffsetT
+	if len(columns) > 0 {
+		offsets := make([]flatbuffers.UOffsetT, len(columns))
+		for i, c := range columns {
+			colName := b.CreateString(c.Name)
+			b.StartObject(11)
+			b.PrependUOffsetTSlot(0, colName, 0)
+			b.PrependByteSlot(1, byte(c.Type), 0)
+			offsets[i] = b.EndObject()
+		}
+		columnsOff = createOffsetVector(b, offsets)
+	}
+
+	org := b.CreateString("EPSG")
+	b.StartObject(6)
+	b.PrependUOffsetTSlot(0, org, 0)
+	b.PrependInt32Slot(1, 4326, 0)
+	crs := b.EndObject()
+
+	b.StartObject(14)
+	b.PrependUOffsetTSlot(0, nameOff, 0)
+	b.PrependUOffsetTSlot(1, envelopeOff, 0)
+	b.PrependByteSlot(2, byte(gtype), 0)
+	b.PrependUOffsetTSlot(7, columnsOff, 0)
+	b.PrependUint64Slot(8, count, 0)
+	b.PrependUint16Slot(9, nodeSize, NodeSize)
+	b.PrependUOffsetTSlot(10, crs, 0)
+	b.Finish(b.EndObject())
+
+	return b.FinishedBytes()
+}
+
+func encodeFeature(f *feature, columns []Column, gtype geometryType) ([]byte, error) {
+	b := flatbuffers.NewBuilder(1024)
+
+	props, err := encodeProperties(f.Properties, columns)
+	if err != nil {
+		return nil, err
+	}
+	propsOff := b.CreateByteVector(props)
+
+	// The geometry type is only stored in the feature when the header
+	// doesn't define it
+	var geomOff flatbuffers.UOffsetT
+	switch f.Geometry.Type {
+	case geojson.GeometryPolygon:
+		geomOff = encodePolygon(b, f.Geometry.Polygon, gtype == geometryUnknown)
+	case geojson.GeometryMultiPolygon:
+		parts := make([]flatbuffers.UOffsetT, len(f.Geometry.MultiPolygon))
+		for i, poly := range f.Geometry.MultiPolygon {
+			parts[i] = encodePolygon(b, poly, true)
+		}
+		partsOff := createOffsetVector(b, parts)
+
+		b.StartObject(8)
+		b.PrependUOffsetTSlot(7, partsOff, 0)
+		if gtype == geometryUnknown {
+			b.PrependByteSlot(6, byte(geometryMultiPolygon), 0)
+		}
+		geomOff = b.EndObject()
+	}
+
+	b.StartObject(3)
+	b.PrependUOffsetTSlot(0, geomOff, 0)
+	b.PrependUOffsetTSlot(1, propsOff, 0)
+	b.Finish(b.EndObject())
+
+	return b.FinishedBytes(), nil
+}
+
+// Polygons store the coordinates of all rings in one vector, along with the
+// end of each ring (only needed when there are holes)
+func encodePolygon(b *flatbuffers.Builder, rings [][][]float64, withType bool) flatbuffers.UOffsetT {
+	xy := make([]float64, 0)
+	ends := make([]uint32, 0, len(rings))
+	for _, ring := range rings {
+		for _, p := range ring {
+			xy = append(xy, p[0], p[1])
+		}
+		ends = append(ends, uint32(len(xy)/2))
+	}
+
+	var endsOff flatbuffers.UOffsetT
+	if len(ends) > 1 {
+		b.StartVector(4, len(ends), 4)
+		for i := len(ends) - 1; i >= 0; i-- {
+			b.PrependUint32(ends[i])
+		}
+		endsOff = b.EndVector(len(ends))
+	}
+	xyOff := createFloat64Vector(b, xy)
+
+	b.StartObject(8)
+	b.PrependUOffsetTSlot(0, endsOff, 0)
+	b.PrependUOffsetTSlot(1, xyOff, 0)
+	if withType {
+		b.PrependByteSlot(6, byte(geometryPolygon), 0)
+	}
+	return b.EndObject()
+}
+
+// Properties are encoded as a sequence of (column index, value) pairs.
+// Missing values are left out.
+func encodeProperties(props map[string]interface{}, columns []Column) ([]byte, error) {
+	result := make([]byte, 0)
+	var buf [8]byte
+	for i, c := range columns {
+		v, ok := props[c.Name]
+		if !ok || v == nil {
+			continue
+		}
+
+		binary.LittleEndian.PutUint16(buf[:], uint16(i))
+		result = append(result, buf[:2]...)
+
+		switch c.Type {
+		case ColumnString:
+			s := v.(string)
+			binary.LittleEndian.PutUint32(buf[:], uint32(len(s)))
+			result = append(result, buf[:4]...)
+			result = append(result, s...)
+		case ColumnDouble:
+			var f float64
+			switch n := v.(type) {
+			case float64:
+				f = n
+			case float32:
+				f = float64(n)
+			}
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+			result = append(result, buf[:8]...)
+		case ColumnLong:
+			var l int64
+			switch n := v.(type) {
+			case int:
+				l = int64(n)
+			case int32:
+				l = int64(n)
+			case int64:
+				l = n
+			}
+			binary.LittleEndian.PutUint64(buf[:], uint64(l))
+			result = append(result, buf[:8]...)
+		case ColumnBool:
+			if v.(bool) {
+				result = append(result, 1)
+			} else {
+				result = append(result, 0)
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported column type: %d", c.Type)
+		}
+	}
+	return result, nil
+}
+
+func createFloat64Vector(b *flatbuffers.Builder, v []float64) flatbuffers.UOffsetT {
+	b.StartVector(8, len(v), 8)
+	for i := len(v) - 1; i >= 0; i-- {
+		b.PrependFloat64(v[i])
+	}
+	return b.EndVector(len(v))
+}
+
+func createOffsetVector(b *flatbuffers.Builder, v []flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	b.StartVector(4, len(v), 4)
+	for i := len(v) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(v[i])
+	}
+	return b.EndVector(len(v))
+}
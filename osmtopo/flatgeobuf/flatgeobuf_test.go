@@ -0,0 +1,131 @@
+package flatgeobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/cheekybits/is"
+	flatbuffers "github.com/google/flatbuffers/go"
+	geojson "github.com/paulmach/go.geojson"
+)
+
+func square(x, y, size float64) [][][]float64 {
+	return [][][]float64{
+		{{x, y}, {x + size, y}, {x + size, y + size}, {x, y + size}, {x, y}},
+	}
+}
+
+// Returns the table at the given position of a size-prefixed buffer, along
+// with the position after it
+func readTable(data []byte, pos int) (*flatbuffers.Table, int) {
+	size := int(binary.LittleEndian.Uint32(data[pos:]))
+	buf := data[pos+4 : pos+4+size]
+	return &flatbuffers.Table{
+		Bytes: buf,
+		Pos:   flatbuffers.GetUOffsetT(buf),
+	}, pos + 4 + size
+}
+
+// Offset of a field in the vtable of a table
+func field(slot int) flatbuffers.VOffsetT {
+	return flatbuffers.VOffsetT(4 + 2*slot)
+}
+
+func TestWrite(t *testing.T) {
+	is := is.New(t)
+
+	fc := geojson.NewFeatureCollection()
+	for i := 0; i < 20; i++ {
+		f := geojson.NewPolygonFeature(square(float64(i), float64(i%4), 0.5))
+		f.SetProperty("id", "1234")
+		f.SetProperty("name", "Square")
+		fc.AddFeature(f)
+	}
+	f := geojson.NewMultiPolygonFeature(square(30, 2, 1), square(32, 2, 1))
+	f.SetProperty("id", "5678")
+	fc.AddFeature(f)
+
+	var buf bytes.Buffer
+	err := Write(&buf, "squares", fc)
+	is.NoErr(err)
+
+	data := buf.Bytes()
+	is.Equal(data[:8], magic)
+
+	header, pos := readTable(data, 8)
+	is.Equal(string(header.ByteVector(flatbuffers.UOffsetT(header.Offset(field(0)))+header.Pos)), "squares")
+	is.Equal(header.GetUint64(header.Pos+flatbuffers.UOffsetT(header.Offset(field(8)))), uint64(21))
+
+	// Mixed geometry types, so no type in the header
+	is.Equal(header.Offset(field(2)), flatbuffers.VOffsetT(0))
+
+	// Two columns: id and name
+	columns := header.Offset(field(7))
+	is.True(columns != 0)
+	is.Equal(header.VectorLen(flatbuffers.UOffsetT(columns)), 2)
+
+	// Index: 21 leaves and 2 levels above them
+	indexSize := IndexSize(21, NodeSize)
+	is.Equal(indexSize, (21+2+1)*40)
+
+	readNode := func(i int) node {
+		b := data[pos+i*40:]
+		return node{
+			MinX:   math.Float64frombits(binary.LittleEndian.Uint64(b[0:])),
+			MinY:   math.Float64frombits(binary.LittleEndian.Uint64(b[8:])),
+			MaxX:   math.Float64frombits(binary.LittleEndian.Uint64(b[16:])),
+			MaxY:   math.Float64frombits(binary.LittleEndian.Uint64(b[24:])),
+			Offset: binary.LittleEndian.Uint64(b[32:]),
+		}
+	}
+
+	root := readNode(0)
+	is.Equal(root.MinX, 0.0)
+	is.Equal(root.MinY, 0.0)
+	is.Equal(root.MaxX, 33.0)
+	is.Equal(root.MaxY, 3.5)
+	is.Equal(root.Offset, uint64(1))
+
+	// Leaves point to the features
+	features := pos + indexSize
+	for i := 0; i < 21; i++ {
+		leaf := readNode(3 + i)
+
+		feature, _ := readTable(data, features+int(leaf.Offset))
+		geom := feature.Offset(field(0))
+		is.True(geom != 0)
+		is.True(feature.Offset(field(1)) != 0)
+	}
+
+	// All features are there
+	count := 0
+	for p := features; p < len(data); count++ {
+		_, p = readTable(data, p)
+	}
+	is.Equal(count, 21)
+}
+
+func TestWriteEmpty(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	err := Write(&buf, "empty", geojson.NewFeatureCollection())
+	is.NoErr(err)
+
+	data := buf.Bytes()
+	header, pos := readTable(data, 8)
+	is.Equal(pos, len(data))
+
+	// No index
+	is.Equal(header.GetUint16(header.Pos+flatbuffers.UOffsetT(header.Offset(field(9)))), uint16(0))
+}
+
+func TestLevelBounds(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(levelBounds(1, 16), [][2]int{{1, 2}, {0, 1}})
+	is.Equal(levelBounds(20, 16), [][2]int{{3, 23}, {1, 3}, {0, 1}})
+	is.Equal(IndexSize(0, 16), 0)
+}
@@ -0,0 +1,201 @@
+package flatgeobuf
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+)
+
+// Node of the packed R-tree. For leaves, Offset is the byte offset of the
+// feature in the features section. For other nodes, it's the index of the
+// first child.
+type node struct {
+	MinX   float64
+	MinY   float64
+	MaxX   float64
+	MaxY   float64
+	Offset uint64
+}
+
+func emptyNode() node {
+	return node{
+		MinX: math.Inf(1),
+		MinY: math.Inf(1),
+		MaxX: math.Inf(-1),
+		MaxY: math.Inf(-1),
+	}
+}
+
+func (n *node) expand(o node) {
+	n.MinX = math.Min(n.MinX, o.MinX)
+	n.MinY = math.Min(n.MinY, o.MinY)
+	n.MaxX = math.Max(n.MaxX, o.MaxX)
+	n.MaxY = math.Max(n.MaxY, o.MaxY)
+}
+
+func (n *node) expandRings(rings [][][]float64) {
+	for _, ring := range rings {
+		for _, p := range ring {
+			n.expand(node{MinX: p[0], MinY: p[1], MaxX: p[0], MaxY: p[1]})
+		}
+	}
+}
+
+// Start and end index of each level of the tree, leaves first. The tree is
+// stored with the root first and the leaves last.
+func levelBounds(numItems int, nodeSize int) [][2]int {
+	counts := []int{numItems}
+	n := numItems
+	total := n
+	for {
+		n = (n + nodeSize - 1) / nodeSize
+		total += n
+		counts = append(counts, n)
+		if n == 1 {
+			break
+		}
+	}
+
+	result := make([][2]int, len(counts))
+	end := total
+	for i, count := range counts {
+		result[i] = [2]int{end - count, end}
+		end -= count
+	}
+	return result
+}
+
+// Builds the packed R-tree on top of the given leaves and writes it
+func writeIndex(w io.Writer, leaves []node, nodeSize uint16) error {
+	bounds := levelBounds(len(leaves), int(nodeSize))
+	nodes := make([]node, bounds[0][1])
+	copy(nodes[bounds[0][0]:], leaves)
+
+	for level := 0; level < len(bounds)-1; level++ {
+		pos := bounds[level][0]
+		end := bounds[level][1]
+		parent := bounds[level+1][0]
+		for pos < end {
+			n := emptyNode()
+			n.Offset = uint64(pos)
+			for j := 0; j < int(nodeSize) && pos < end; j++ {
+				n.expand(nodes[pos])
+				pos++
+			}
+			nodes[parent] = n
+			parent++
+		}
+	}
+
+	var buf [40]byte
+	for _, n := range nodes {
+		binary.LittleEndian.PutUint64(buf[0:], math.Float64bits(n.MinX))
+		binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(n.MinY))
+		binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(n.MaxX))
+		binary.LittleEndian.PutUint64(buf[24:], math.Float64bits(n.MaxY))
+		binary.LittleEndian.PutUint64(buf[32:], n.Offset)
+		_, err := w.Write(buf[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size in bytes of the index for the given number of features
+func IndexSize(numItems int, nodeSize int) int {
+	if numItems == 0 || nodeSize == 0 {
+		return 0
+	}
+	bounds := levelBounds(numItems, nodeSize)
+	return bounds[0][1] * 40
+}
+
+const hilbertMax = (1 << 16) - 1
+
+// Orders features along the Hilbert curve through the centers of their
+// bounding boxes, the order expected by the spatial index
+func hilbertSort(features []*feature, extent node) {
+	width := extent.MaxX - extent.MinX
+	height := extent.MaxY - extent.MinY
+
+	order := make(byHilbert, len(features))
+	for i, f := range features {
+		var x, y uint32
+		if width > 0 {
+			x = uint32(math.Floor(hilbertMax * ((f.Bounds.MinX+f.Bounds.MaxX)/2 - extent.MinX) / width))
+		}
+		if height > 0 {
+			y = uint32(math.Floor(hilbertMax * ((f.Bounds.MinY+f.Bounds.MaxY)/2 - extent.MinY) / height))
+		}
+		order[i] = hilbertEntry{
+			Feature: f,
+			Value:   hilbert(x, y),
+		}
+	}
+	sort.Stable(order)
+
+	for i, entry := range order {
+		features[i] = entry.Feature
+	}
+}
+
+type hilbertEntry struct {
+	Feature *feature
+	Value   uint32
+}
+
+type byHilbert []hilbertEntry
+
+func (h byHilbert) Len() int           { return len(h) }
+func (h byHilbert) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h byHilbert) Less(i, j int) bool { return h[i].Value > h[j].Value }
+
+// Position of (x, y) on the Hilbert curve, both coordinates are 16 bits. See
+// http://threadlocalmutex.com/?p=126
+func hilbert(x, y uint32) uint32 {
+	a := x ^ y
+	b := 0xFFFF ^ a
+	c := 0xFFFF ^ (x | y)
+	d := x & (y ^ 0xFFFF)
+
+	A := a | (b >> 1)
+	B := (a >> 1) ^ a
+	C := ((c >> 1) ^ (b & (d >> 1))) ^ c
+	D := ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 2)) ^ (b & (b >> 2))
+	B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+	C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+	D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 4)) ^ (b & (b >> 4))
+	B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+	C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+	D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+	a, b, c, d = A, B, C, D
+	C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+	D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+	a = C ^ (C >> 1)
+	b = D ^ (D >> 1)
+
+	i0 := x ^ y
+	i1 := b | (0xFFFF ^ (i0 | a))
+
+	i0 = (i0 | (i0 << 8)) & 0x00FF00FF
+	i0 = (i0 | (i0 << 4)) & 0x0F0F0F0F
+	i0 = (i0 | (i0 << 2)) & 0x33333333
+	i0 = (i0 | (i0 << 1)) & 0x55555555
+
+	i1 = (i1 | (i1 << 8)) & 0x00FF00FF
+	i1 = (i1 | (i1 << 4)) & 0x0F0F0F0F
+	i1 = (i1 | (i1 << 2)) & 0x33333333
+	i1 = (i1 | (i1 << 1)) & 0x55555555
+
+	return (i1 << 1) | i0
+}
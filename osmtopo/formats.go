@@ -0,0 +1,159 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/rubenv/osmtopo/osmtopo/flatgeobuf"
+	"github.com/rubenv/topojson"
+)
+
+const (
+	FormatTopoJSON   = "topojson"
+	FormatGeoJSON    = "geojson"
+	FormatNDJSON     = "ndjson"
+	FormatFlatGeobuf = "flatgeobuf"
+	FormatMVT        = "mvt"
+	FormatMBTiles    = "mbtiles"
+	FormatShapefile  = "shapefile"
+)
+
+// File extension of each single-file output format
+var formatExtensions = map[string]string{
+	FormatGeoJSON:    ".geojson",
+	FormatNDJSON:     ".ndjson",
+	FormatFlatGeobuf: ".fgb",
+	FormatMBTiles:    ".mbtiles",
+	FormatShapefile:  ".shp",
+}
+
+// Vector tiles are written to a folder in the layer folder
+const tilesFolder = "tiles"
+
+// Output formats of the layer, defaults to TopoJSON
+func (l Layer) OutputFormats() ([]string, error) {
+	if len(l.Formats) == 0 {
+		return []string{FormatTopoJSON}, nil
+	}
+
+	for _, format := range l.Formats {
+		_, ok := formatExtensions[format]
+		if !ok && format != FormatTopoJSON && format != FormatMVT {
+			return nil, fmt.Errorf("Unknown export format: %s", format)
+		}
+	}
+	return l.Formats, nil
+}
+
+// Unlike TopoJSON, the other formats aren't sliced: all features of a layer
+// end up in a single file, named after the layer.
+func formatFilename(folder string, layer Layer, format string) string {
+	if format == FormatMVT {
+		return path.Join(folder, tilesFolder)
+	}
+	return path.Join(folder, layer.ID+formatExtensions[format])
+}
+
+// Converts the exported topology back to features, ordered by ID
+func topologyFeatures(topo *topojson.Topology) *geojson.FeatureCollection {
+	fc := topo.ToGeoJSON()
+	sortFeatures(fc)
+	return fc
+}
+
+func writeFormat(filename string, layer Layer, format string, fc *geojson.FeatureCollection) error {
+	switch format {
+	case FormatMVT, FormatMBTiles:
+		return writeTiles(filename, layer, format, fc)
+	case FormatShapefile:
+		return writeShapefile(filename, fc)
+	}
+
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatGeoJSON:
+		err = json.NewEncoder(fp).Encode(fc)
+	case FormatNDJSON:
+		// One feature per line
+		enc := json.NewEncoder(fp)
+		for _, f := range fc.Features {
+			err = enc.Encode(f)
+			if err != nil {
+				break
+			}
+		}
+	case FormatFlatGeobuf:
+		err = flatgeobuf.Write(fp, layer.Name, fc)
+	default:
+		err = fmt.Errorf("Unknown export format: %s", format)
+	}
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	return fp.Close()
+}
+
+// Removes the files of formats that are no longer exported
+func removeStaleFormats(folder string, layer Layer, formats []string) error {
+	keep := make(map[string]bool)
+	for _, format := range formats {
+		keep[format] = true
+	}
+
+	if !keep[FormatMVT] {
+		err := os.RemoveAll(formatFilename(folder, layer, FormatMVT))
+		if err != nil {
+			return err
+		}
+	}
+
+	for format := range formatExtensions {
+		if keep[format] {
+			continue
+		}
+
+		filename := formatFilename(folder, layer, format)
+		if format == FormatShapefile {
+			err := removeShapefile(filename)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the file is part of an export: a slice, a manifest or one of the
+// single-file outputs
+func isExportFile(name string) bool {
+	if name == manifestFile || strings.HasSuffix(name, ".topojson") {
+		return true
+	}
+	for _, ext := range formatExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	for _, ext := range shapefileSidecars {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
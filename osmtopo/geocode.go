@@ -0,0 +1,104 @@
+package osmtopo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rubenv/osmtopo/osmtopo/lookup"
+)
+
+// Maximum number of points in a single batch lookup request
+const MaxLookupBatch = 10000
+
+type LookupResult struct {
+	Lat    float64                   `json:"lat"`
+	Lon    float64                   `json:"lon"`
+	Layers map[string][]*LookupMatch `json:"layers"`
+}
+
+type LookupMatch struct {
+	ID         int64             `json:"id"`
+	Name       string            `json:"name"`
+	Names      map[string]string `json:"names,omitempty"`
+	AdminLevel int               `json:"admin_level"`
+}
+
+type LookupPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Builds the lookup index of all relations in the configured layers
+func (e *Env) LoadLookup() error {
+	return e.loadLookup()
+}
+
+// Builds the lookup index of the selected topologies
+func (e *Env) LoadTopologies() error {
+	return e.loadTopologies()
+}
+
+// Finds the relations that contain a given point, for each of the given
+// layers (or all configured layers when none are given).
+//
+// When all is set, every relation in the store that fits the layer is
+// considered. Otherwise only the selected topologies are used.
+func (e *Env) Lookup(lat, lon float64, layers []string, all bool) (*LookupResult, error) {
+	return e.lookupPoint(e.lookupIndex(all), lat, lon, layers)
+}
+
+// Like Lookup, using the given index. Batches query one index, even when it
+// gets replaced halfway.
+func (e *Env) lookupPoint(index *lookup.Data, lat, lon float64, layers []string) (*LookupResult, error) {
+	if index == nil {
+		return nil, errors.New("Lookup index not loaded")
+	}
+
+	if len(layers) == 0 {
+		for _, layer := range e.config.Layers {
+			layers = append(layers, layer.ID)
+		}
+	}
+
+	result := &LookupResult{
+		Lat:    lat,
+		Lon:    lon,
+		Layers: make(map[string][]*LookupMatch),
+	}
+	for _, layer := range layers {
+		matches, err := e.queryLookup(index, lat, lon, layer)
+		if err != nil {
+			return nil, err
+		}
+
+		found := make([]*LookupMatch, 0, len(matches))
+		for _, id := range matches {
+			rel, err := e.GetRelation(id)
+			if err != nil {
+				return nil, err
+			}
+			if rel == nil {
+				continue
+			}
+
+			name, _ := rel.GetTag("name")
+			match := &LookupMatch{
+				ID:         id,
+				Name:       name,
+				AdminLevel: rel.GetAdminLevel(),
+			}
+			for _, lang := range e.config.Languages {
+				if v, ok := rel.GetTag(fmt.Sprintf("name:%s", lang)); ok {
+					if match.Names == nil {
+						match.Names = make(map[string]string)
+					}
+					match.Names[lang] = v
+				}
+			}
+			found = append(found, match)
+		}
+		result.Layers[layer] = found
+	}
+
+	return result, nil
+}
@@ -1,9 +1,14 @@
 package osmtopo
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math"
 	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 
 	geojson "github.com/paulmach/go.geojson"
@@ -22,15 +27,24 @@ type clipGeometry struct {
 }
 
 type GeometryPipeline struct {
-	id        int64
-	env       *Env
-	simplify  int
-	quantize  float64
-	clipwater bool
-	accept    RelationFilterFunc
-	languages []string
+	id         int64
+	env        *Env
+	simplify   int
+	quantize   float64
+	clipwater  bool
+	accept     RelationFilterFunc
+	languages  []string
+	properties []Property
+
+	cacheClipped bool
+	reuseClipped bool
+	cacheLayer   string
 
 	Timing *servertiming.Timing
+
+	// IDs of the relations that got clipped during Run, rather than being
+	// loaded from the cache
+	Clipped []int64
 }
 
 func NewGeometryPipeline(e *Env) *GeometryPipeline {
@@ -60,6 +74,12 @@ func (p *GeometryPipeline) WithNames(languages []string) *GeometryPipeline {
 	return p
 }
 
+// Copies the given tags into the output properties
+func (p *GeometryPipeline) WithProperties(properties []Property) *GeometryPipeline {
+	p.properties = properties
+	return p
+}
+
 func (p *GeometryPipeline) ClipWater() *GeometryPipeline {
 	p.clipwater = true
 	return p
@@ -70,6 +90,41 @@ func (p *GeometryPipeline) Filter(accept RelationFilterFunc) *GeometryPipeline {
 	return p
 }
 
+// Stores the water-clipped geometry of each relation in the cache of the
+// given layer. When reuse is set, relations that were clipped before are
+// loaded from this cache instead of being clipped again, as long as their
+// pre-clipping simplification didn't change.
+func (p *GeometryPipeline) CacheClipped(layer string, reuse bool) *GeometryPipeline {
+	p.cacheClipped = true
+	p.reuseClipped = reuse
+	p.cacheLayer = layer
+	return p
+}
+
+// Geometry prefix of the clipped geometries cache of a layer. The cache
+// depends on the simplification that's applied before clipping, which covers
+// all relations of the layer.
+func clipPrefix(layer string, simplify int) string {
+	return fmt.Sprintf("clip/%s/%d", layer, simplify)
+}
+
+// Cached water-clipped geometry, along with a hash of the geometry it was
+// clipped from. Simplifying the topology of a layer can change the shared
+// borders of a relation when one of its neighbours changes.
+type clippedGeometry struct {
+	Input    string            `json:"input"`
+	Geometry *geojson.Geometry `json:"geometry"`
+}
+
+func geometryHash(g *geojson.Geometry) (string, error) {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 func (p *GeometryPipeline) Run() (*topojson.Topology, error) {
 	var g errgroup.Group
 
@@ -160,6 +215,17 @@ func (p *GeometryPipeline) Run() (*topojson.Topology, error) {
 					}
 				}
 
+				// Copy extra properties, the ID can't be overridden
+				for _, prop := range p.properties {
+					name := prop.OutputName()
+					if name == "id" {
+						continue
+					}
+					if v, ok := rel.GetTag(prop.Tag); ok {
+						out.SetProperty(name, v)
+					}
+				}
+
 				geometries <- out
 			}
 		})
@@ -189,6 +255,7 @@ func (p *GeometryPipeline) Run() (*topojson.Topology, error) {
 			}
 			fc.AddFeature(f)
 		}
+		sortFeatures(fc)
 
 		if p.simplify > 0 && p.clipwater {
 			p.Timing.Start("pre-simplify", "Pre-clipping simplification")
@@ -214,18 +281,73 @@ func (p *GeometryPipeline) Run() (*topojson.Topology, error) {
 			return nil
 		}
 
-		p.Timing.Start("loadwater", "Load water")
-		clipGeos, err := p.env.loadWaterClipGeos(maxErr)
-		if err != nil {
-			return err
+		// Water is only loaded when something needs to be clipped
+		var clipGeos []*clipGeometry
+		waterLoaded := false
+		loadWater := func() error {
+			if waterLoaded {
+				return nil
+			}
+
+			p.Timing.Start("loadwater", "Load water")
+			defer p.Timing.Stop("loadwater")
+
+			c, err := p.env.loadWaterClipGeos(maxErr)
+			if err != nil {
+				return err
+			}
+			clipGeos = c
+			waterLoaded = true
+			return nil
 		}
-		p.Timing.Stop("loadwater")
 
 		p.Timing.Start("clip", "Clip water")
 		defer p.Timing.Stop("clip")
 
+		prefix := clipPrefix(p.cacheLayer, p.simplify)
 		out := geojson.NewFeatureCollection()
 		for _, feat := range in.Features {
+			idStr, err := feat.PropertyString("id")
+			if err != nil {
+				return err
+			}
+			id, err := strconv.ParseInt(idStr, 10, 64)
+			if err != nil {
+				return err
+			}
+
+			input := ""
+			if p.cacheClipped {
+				input, err = geometryHash(feat.Geometry)
+				if err != nil {
+					return err
+				}
+			}
+
+			if p.reuseClipped {
+				cached, err := p.env.GetGeometry(prefix, id)
+				if err != nil {
+					return err
+				}
+				if cached != nil {
+					c := &clippedGeometry{}
+					err = json.Unmarshal(cached.Geojson, c)
+					if err != nil {
+						return err
+					}
+					if c.Input == input && c.Geometry != nil {
+						feat.Geometry = c.Geometry
+						out.AddFeature(feat)
+						continue
+					}
+				}
+			}
+
+			err = loadWater()
+			if err != nil {
+				return err
+			}
+
 			geom, err := GeometryToGeos(feat.Geometry)
 			if err != nil {
 				return err
@@ -258,6 +380,26 @@ func (p *GeometryPipeline) Run() (*topojson.Topology, error) {
 			if err != nil {
 				return err
 			}
+
+			if p.cacheClipped {
+				data, err := json.Marshal(&clippedGeometry{
+					Input:    input,
+					Geometry: g,
+				})
+				if err != nil {
+					return err
+				}
+
+				err = p.env.addGeometry(prefix, &model.Geometry{
+					Id:      id,
+					Geojson: data,
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			p.Clipped = append(p.Clipped, id)
 			feat.Geometry = g
 			out.AddFeature(feat)
 		}
@@ -271,6 +413,11 @@ func (p *GeometryPipeline) Run() (*topojson.Topology, error) {
 	g.Go(func() error {
 		defer close(quantized)
 		fc := <-clipped
+		if fc == nil {
+			return nil
+		}
+		sortFeatures(fc)
+
 		p.Timing.Start("post-simplify", "Post-clipping simplification")
 		topo := topojson.NewTopology(fc, &topojson.TopologyOptions{
 			PostQuantize: p.quantize,
@@ -289,3 +436,23 @@ func (p *GeometryPipeline) Run() (*topojson.Topology, error) {
 
 	return <-quantized, nil
 }
+
+// Orders features by ID. Geometries are loaded concurrently, sorting them
+// makes the generated topology independent of the order in which they were
+// loaded.
+func sortFeatures(fc *geojson.FeatureCollection) {
+	sort.Sort(featuresByID(fc.Features))
+}
+
+type featuresByID []*geojson.Feature
+
+func (f featuresByID) Len() int      { return len(f) }
+func (f featuresByID) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f featuresByID) Less(i, j int) bool {
+	a, _ := f[i].PropertyString("id")
+	b, _ := f[j].PropertyString("id")
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/omniscale/imposm3/parser/pbf"
 	"github.com/rubenv/osmtopo/osmtopo/model"
 	"github.com/rubenv/osmtopo/osmtopo/needidx"
+	"github.com/tecbot/gorocksdb"
 	"github.com/uber-go/atomic"
 )
 
@@ -36,16 +37,33 @@ type importer struct {
 	relationCount *atomic.Int64
 	seq           *atomic.Int64
 	phase         *atomic.String
+	phaseStarted  *atomic.Int64
+	phaseBase     *atomic.Int64
+	phaseTotal    *atomic.Int64
 
 	nodesNeeded *needidx.NeedIdx
 	waysNeeded  *needidx.NeedIdx
+
+	// Area of interest: relations are spooled, only the ones inside of it
+	// get stored along with their ways and nodes
+	clip *clipArea
+
+	// Import mode, ImportMultiPass or ImportSinglePass
+	mode  string
+	spool *gorocksdb.DB
 }
 
-func newImporter(env *Env, name, filename string) *importer {
+func newImporter(env *Env, name, filename string, clip *clipArea, mode string) *importer {
+	if mode == "" {
+		mode = ImportMultiPass
+	}
+
 	return &importer{
 		env:           env,
 		name:          name,
 		filename:      filename,
+		clip:          clip,
+		mode:          mode,
 		nodesNeeded:   needidx.New(),
 		waysNeeded:    needidx.New(),
 		nodeCount:     atomic.NewInt64(0),
@@ -53,65 +71,72 @@ func newImporter(env *Env, name, filename string) *importer {
 		relationCount: atomic.NewInt64(0),
 		seq:           atomic.NewInt64(0),
 		phase:         atomic.NewString(""),
+		phaseStarted:  atomic.NewInt64(0),
+		phaseBase:     atomic.NewInt64(0),
+		phaseTotal:    atomic.NewInt64(0),
 		progress:      make(chan interface{}),
 	}
 
 }
 
 func (i *importer) Run() (int64, error) {
-	_, err := os.Stat(i.filename)
+	if i.mode != ImportMultiPass && i.mode != ImportSinglePass {
+		return 0, fmt.Errorf("Unknown import mode: %s", i.mode)
+	}
+
+	fi, err := os.Stat(i.filename)
 	if err != nil {
 		return 0, err
 	}
 
-	i.started = time.Now()
-	i.pwg.Add(1)
-	go i.updateProgress()
-
-	// Pass 1: Import relations
-	i.phase.Store("relations")
-	i.prepareChannels()
-	g, ctx := errgroup.WithContext(i.env.ctx)
-	i.ctx = ctx
-	g.Go(i.discardNodes)
-	g.Go(i.discardWays)
-	g.Go(i.importRelations)
-	g.Go(i.startParser)
-	err = g.Wait()
+	parser, err := pbf.NewParser(i.filename)
 	if err != nil {
 		return 0, err
 	}
+	header := parser.Header()
+	i.seq.Store(header.Sequence)
 
-	// Pass 2: Import ways
-	i.phase.Store("ways")
-	i.prepareChannels()
-	g, ctx = errgroup.WithContext(i.env.ctx)
-	i.ctx = ctx
-	g.Go(i.discardNodes)
-	g.Go(i.importWays)
-	g.Go(i.discardRelations)
-	g.Go(i.startParser)
-	err = g.Wait()
+	current := &importCheckpoint{
+		Size:     fi.Size(),
+		Sequence: header.Sequence,
+		Time:     header.Time,
+		Mode:     i.mode,
+		Clip:     i.clip != nil,
+	}
+	cp, err := i.loadCheckpoint(current)
 	if err != nil {
 		return 0, err
 	}
+	if cp != nil {
+		i.log("Resuming import after the %s pass", passNames[cp.Pass])
+	} else {
+		// Whatever is left without a checkpoint (such as the spool of an
+		// import stopped during its first pass) may come from another file
+		err = i.removeCheckpoint()
+		if err != nil {
+			return 0, err
+		}
+		cp = current
+	}
 
-	// Pass 2: Import nodes
-	i.phase.Store("nodes")
-	i.prepareChannels()
-	g, ctx = errgroup.WithContext(i.env.ctx)
-	i.ctx = ctx
-	g.Go(i.importNodes)
-	g.Go(i.discardWays)
-	g.Go(i.discardRelations)
-	g.Go(i.startParser)
-	err = g.Wait()
+	i.started = time.Now()
+	i.pwg.Add(1)
+	go i.updateProgress()
+	defer i.stopProgress()
+
+	if i.mode == ImportSinglePass {
+		err = i.runSinglePass(cp)
+	} else {
+		err = i.runMultiPass(cp)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	close(i.progress)
-	i.pwg.Wait()
+	err = i.removeCheckpoint()
+	if err != nil {
+		return 0, err
+	}
 
 	seconds := int64(time.Since(i.started).Seconds())
 	if seconds == 0 {
@@ -123,6 +148,68 @@ func (i *importer) Run() (int64, error) {
 	return i.seq.Load(), nil
 }
 
+func (i *importer) runMultiPass(cp *importCheckpoint) error {
+	relations, ways, nodes := i.importRelations, i.importWays, i.importNodes
+	if i.clip != nil {
+		// Candidates go to the spool, only what lies inside of the clip
+		// area gets stored afterwards
+		err := i.openSpool()
+		if err != nil {
+			return err
+		}
+		defer i.closeSpool()
+		relations, ways, nodes = i.spoolRelations, i.spoolNeededWays, i.spoolNeededNodes
+	}
+
+	// Pass 1: Import relations
+	if cp.Pass < passRelations {
+		err := i.runPass(cp, passRelations, i.discardNodes, i.discardWays, relations)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Pass 2: Import ways
+	if cp.Pass < passWays {
+		err := i.runPass(cp, passWays, i.discardNodes, ways, i.discardRelations)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Pass 3: Import nodes
+	if cp.Pass < passNodes {
+		err := i.runPass(cp, passNodes, nodes, i.discardWays, i.discardRelations)
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.clip != nil {
+		return i.storeClipped()
+	}
+	return nil
+}
+
+// Runs a pass over the PBF file, with the given functions handling nodes, ways
+// and relations. Stores a checkpoint when done.
+func (i *importer) runPass(cp *importCheckpoint, pass int, nodes, ways, relations func() error) error {
+	i.setPhase(passNames[pass], i.passTotal(pass))
+	i.prepareChannels()
+	g, ctx := errgroup.WithContext(i.env.ctx)
+	i.ctx = ctx
+	g.Go(nodes)
+	g.Go(ways)
+	g.Go(relations)
+	g.Go(i.startParser)
+	err := g.Wait()
+	if err != nil {
+		return err
+	}
+
+	return i.saveCheckpoint(cp, pass)
+}
+
 func (i *importer) log(str string, args ...interface{}) {
 	i.env.log(fmt.Sprintf("import/%s", i.name), str, args...)
 }
@@ -146,9 +233,6 @@ func (i *importer) startParser() error {
 		//parser.Stop()
 	}()
 
-	header := parser.Header()
-	i.seq.Store(header.Sequence)
-
 	parser.Parse(i.coords, i.nodes, i.ways, i.relations)
 
 	close(i.coords)
@@ -159,38 +243,101 @@ func (i *importer) startParser() error {
 	return i.ctx.Err()
 }
 
+// How often import progress gets logged
+const progressLogInterval = 30 * time.Second
+
+// Publishes the progress in the status and logs it now and then
 func (i *importer) updateProgress() {
 	defer i.pwg.Done()
+	defer i.env.setProgress(nil)
 
 	prevNodeCount := int64(0)
 	prevWayCount := int64(0)
 	prevRelationCount := int64(0)
 	every := int64(1)
+	lastLog := time.Now()
 
-loop:
 	for {
 		select {
 		case _, ok := <-i.progress:
 			if !ok {
-				break loop
+				return
 			}
 		case <-time.After(time.Duration(every) * time.Second):
 		}
 
-		executing := time.Since(i.started)
-		newNodes := i.nodeCount.Load() - prevNodeCount
-		newWays := i.wayCount.Load() - prevWayCount
-		newRelations := i.relationCount.Load() - prevRelationCount
+		nodes := i.nodeCount.Load()
+		ways := i.wayCount.Load()
+		relations := i.relationCount.Load()
+
+		p := &Progress{
+			Source:       i.name,
+			Task:         "import",
+			Phase:        i.phase.Load(),
+			Started:      i.started,
+			Nodes:        nodes,
+			Ways:         ways,
+			Relations:    relations,
+			NodeRate:     (nodes - prevNodeCount) / every,
+			WayRate:      (ways - prevWayCount) / every,
+			RelationRate: (relations - prevRelationCount) / every,
+		}
+		if counter := i.phaseCounter(p.Phase); counter != nil {
+			started := time.Unix(0, i.phaseStarted.Load())
+			p.ETA = estimateCompletion(started, counter.Load()-i.phaseBase.Load(), i.phaseTotal.Load())
+		}
+		i.env.setProgress(p)
+
+		if time.Since(lastLog) >= progressLogInterval {
+			i.log("%s: [N: %d (%d/s)] [W: %d (%d/s)] [R: %d (%d/s)]", p.Phase, nodes, p.NodeRate, ways, p.WayRate, relations, p.RelationRate)
+			lastLog = time.Now()
+		}
+
+		prevNodeCount = nodes
+		prevWayCount = ways
+		prevRelationCount = relations
+	}
+}
+
+func (i *importer) stopProgress() {
+	close(i.progress)
+	i.pwg.Wait()
+}
 
-		elapsed := time.Duration(executing.Seconds()) * time.Second
+// Switches to a new phase. The total is the number of elements the phase
+// will import, if known.
+func (i *importer) setPhase(phase string, total int64) {
+	i.phase.Store(phase)
+	i.phaseTotal.Store(total)
+	i.phaseStarted.Store(time.Now().UnixNano())
+	if counter := i.phaseCounter(phase); counter != nil {
+		i.phaseBase.Store(counter.Load())
+	}
+}
 
-		fmt.Printf("\r\033[K[N: %12d (%7d/s)] [W: %12d (%7d/s)] [R: %12d (%7d/s)] %s (%s)", i.nodeCount.Load(), newNodes/every, i.wayCount.Load(), newWays/every, i.relationCount.Load(), newRelations/every, elapsed, i.phase.Load())
+// Counter of the elements imported in a phase, nil when the amount of work
+// is unknown up front
+func (i *importer) phaseCounter(phase string) *atomic.Int64 {
+	switch phase {
+	case passNames[passWays]:
+		return i.wayCount
+	case passNames[passNodes]:
+		return i.nodeCount
+	default:
+		return nil
+	}
+}
 
-		prevNodeCount += newNodes
-		prevWayCount += newWays
-		prevRelationCount += newRelations
+// Number of elements imported in a pass, if known
+func (i *importer) passTotal(pass int) int64 {
+	switch pass {
+	case passWays:
+		return i.waysNeeded.Count()
+	case passNodes:
+		return i.nodesNeeded.Count()
+	default:
+		return 0
 	}
-	fmt.Printf("\r\033[K")
 }
 
 func (i *importer) discardNodes() error {
@@ -361,12 +508,11 @@ loop:
 				}
 			}
 
-			r := RelationFromEl(n)
-			if !AcceptRelation(r, i.env.config.Blacklist) {
+			if !i.env.config.AcceptRelation(n.Id, n.Tags) {
 				continue
 			}
 
-			rels = append(rels, r)
+			rels = append(rels, RelationFromEl(n, i.env.config.AcceptTag))
 		}
 
 		if len(rels) > batchSize {
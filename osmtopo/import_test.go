@@ -0,0 +1,361 @@
+package osmtopo
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cheekybits/is"
+	"github.com/omniscale/imposm3/element"
+	"github.com/omniscale/imposm3/parser/pbf"
+	"github.com/rubenv/osmtopo/osmtopo/model"
+	"github.com/tecbot/gorocksdb"
+)
+
+func TestImportClip(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	config := NewConfig()
+	config.Water = "fixtures/geodata/water-cropped.zip"
+	config.Sources = map[string]PBFSource{
+		"man": PBFSource{
+			Seed: "fixtures/geodata/isle-of-man-latest.osm.pbf",
+			// South-west of the island
+			Clip: []float64{-4.9, 54.0, -4.6, 54.12},
+		},
+	}
+
+	topologiesFile := path.Join(folder, "topo.yaml")
+	storePath := path.Join(folder, "store")
+	outputPath := path.Join(folder, "output")
+
+	env, err := NewEnv(config, topologiesFile, storePath, outputPath)
+	is.NoErr(err)
+	is.NotNil(env)
+	defer env.Stop()
+	env.initialized.Wait()
+
+	for id, kept := range map[int64]bool{
+		62269:   true,  // Isle of Man
+		1061135: true,  // Rushen
+		1061144: false, // Ayre
+		1061145: false, // Garff
+	} {
+		rel, err := env.GetRelation(id)
+		is.NoErr(err)
+		is.Equal(rel != nil, kept)
+	}
+
+	// Only the ways and nodes of kept relations are stored
+	ways := 0
+	forEachKey(is, env, wayKey(0)[:4], func(id int64) {
+		rels, err := env.getWayRelations(id)
+		is.NoErr(err)
+		is.True(len(rels) > 0)
+		ways++
+	})
+	is.True(ways > 0)
+
+	nodes := 0
+	forEachKey(is, env, nodeKey(0)[:5], func(id int64) {
+		ways, err := env.getNodeWays(id)
+		is.NoErr(err)
+		is.True(len(ways) > 0)
+		nodes++
+	})
+	is.True(nodes > 0)
+}
+
+// Calls fn with the ID of each stored element with the given key prefix
+func forEachKey(is is.I, env *Env, prefix []byte, fn func(id int64)) {
+	it := env.db.NewIterator(gorocksdb.NewDefaultReadOptions())
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Key()
+		k := key.Data()
+		if len(k) == len(prefix)+8 {
+			fn(int64(binary.BigEndian.Uint64(k[len(prefix):])))
+		}
+		key.Free()
+	}
+	is.NoErr(it.Err())
+}
+
+func TestImportSinglePass(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	filename := "fixtures/geodata/isle-of-man-latest.osm.pbf"
+	open := func(name string) *Env {
+		env, err := prepareEnv(NewConfig(), path.Join(folder, name, "topo.yaml"), path.Join(folder, name, "store"), path.Join(folder, name, "output"), false)
+		is.NoErr(err)
+		return env
+	}
+
+	multi := open("multi")
+	defer multi.Stop()
+	is.NoErr(multi.ImportFileMode("man", filename, ImportMultiPass))
+
+	single := open("single")
+	defer single.Stop()
+	is.NoErr(single.ImportFileMode("man", filename, ImportSinglePass))
+	isSameStore(is, multi, single)
+
+	// Interrupted after spooling, the resumed import picks up the spool
+	resumed := open("resumed")
+	defer resumed.Stop()
+
+	fi, err := os.Stat(filename)
+	is.NoErr(err)
+	parser, err := pbf.NewParser(filename)
+	is.NoErr(err)
+	header := parser.Header()
+	cp := &importCheckpoint{
+		Size:     fi.Size(),
+		Sequence: header.Sequence,
+		Time:     header.Time,
+		Mode:     ImportSinglePass,
+	}
+
+	i := newImporter(resumed, "man", filename, nil, ImportSinglePass)
+	is.NoErr(i.openSpool())
+	err = i.runPass(cp, passRelations, i.spoolNodes, i.spoolWays, i.importRelations)
+	i.closeSpool()
+	is.NoErr(err)
+	isFile(is, path.Join(folder, "resumed/store/import/man/spool"))
+
+	is.NoErr(resumed.ImportFileMode("man", filename, ImportSinglePass))
+	isSameStore(is, multi, resumed)
+	_, err = os.Stat(path.Join(folder, "resumed/store/import/man"))
+	is.True(os.IsNotExist(err))
+}
+
+func TestImportStaleSpool(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	config := NewConfig()
+	config.Sources = map[string]PBFSource{
+		"man": PBFSource{
+			Seed: "fixtures/geodata/isle-of-man-latest.osm.pbf",
+			Clip: []float64{-4.9, 54.0, -4.6, 54.12},
+		},
+	}
+	env, err := prepareEnv(config, path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	// Import of another file, stopped before its first checkpoint
+	i := newImporter(env, "man", "other.osm.pbf", nil, ImportSinglePass)
+	is.NoErr(i.openSpool())
+	rel := model.Relation{
+		Id:      999999001,
+		Members: []*model.MemberEntry{{Id: 999999002, Type: int32(element.WAY), Role: "outer"}},
+	}
+	data, err := rel.Marshal()
+	is.NoErr(err)
+	is.NoErr(i.spool.Put(env.wo, relationKey(rel.Id), data))
+	way := model.Way{Id: 999999002, Refs: []int64{999999003}}
+	data, err = way.Marshal()
+	is.NoErr(err)
+	is.NoErr(i.spool.Put(env.wo, wayKey(way.Id), data))
+	node := model.Node{Id: 999999003, Lon: -4.7, Lat: 54.05}
+	data, err = node.Marshal()
+	is.NoErr(err)
+	is.NoErr(i.spool.Put(env.wo, nodeKey(node.Id), data))
+	i.closeSpool()
+	isFile(is, path.Join(folder, "store/import/man/spool"))
+
+	is.NoErr(env.ImportFileMode("man", "fixtures/geodata/isle-of-man-latest.osm.pbf", ImportSinglePass))
+
+	r, err := env.GetRelation(rel.Id)
+	is.NoErr(err)
+	is.Nil(r)
+	w, err := env.GetWay(way.Id)
+	is.NoErr(err)
+	is.Nil(w)
+	n, err := env.GetNode(node.Id)
+	is.NoErr(err)
+	is.Nil(n)
+
+	r, err = env.GetRelation(1061135) // Rushen
+	is.NoErr(err)
+	is.NotNil(r)
+}
+
+// Checks that two stores hold the same elements, reverse indexes and source
+// state
+func isSameStore(is is.I, a, b *Env) {
+	for _, prefix := range []string{"relation/", "way/", "node/", "nodeways/", "wayrels/"} {
+		is.Equal(storedEntries(is, a, prefix), storedEntries(is, b, prefix))
+	}
+
+	for _, key := range []string{"seq/man"} {
+		va, err := a.getInt(key)
+		is.NoErr(err)
+		vb, err := b.getInt(key)
+		is.NoErr(err)
+		is.Equal(va, vb)
+	}
+	for _, flag := range []string{"imported/man", "reverse-index"} {
+		va, err := a.getFlag(flag)
+		is.NoErr(err)
+		vb, err := b.getFlag(flag)
+		is.NoErr(err)
+		is.True(va)
+		is.Equal(va, vb)
+	}
+}
+
+// Reads all stored entries with the given key prefix. Relation tags get
+// sorted, they are stored in map iteration order.
+func storedEntries(is is.I, env *Env, prefix string) map[string]string {
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+
+	it := env.db.NewIterator(ro)
+	defer it.Close()
+
+	result := make(map[string]string)
+	p := []byte(prefix)
+	for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+		key := it.Key()
+		value := it.Value()
+		k := string(key.Data())
+		v := value.Data()
+		if prefix == "relation/" {
+			rel := model.Relation{}
+			is.NoErr(rel.Unmarshal(v))
+			sort.Slice(rel.Tags, func(i, j int) bool {
+				return rel.Tags[i].Key < rel.Tags[j].Key
+			})
+			data, err := rel.Marshal()
+			is.NoErr(err)
+			v = data
+		}
+		result[k] = string(v)
+		key.Free()
+		value.Free()
+	}
+	is.NoErr(it.Err())
+	is.True(len(result) > 0)
+	return result
+}
+
+func TestImportCheckpoint(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, err := prepareEnv(NewConfig(), path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	current := &importCheckpoint{
+		Size:     1234,
+		Sequence: 2500,
+		Time:     time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC),
+		Mode:     ImportMultiPass,
+	}
+
+	// Nothing to resume
+	i := newImporter(env, "man", "man.osm.pbf", nil, "")
+	cp, err := i.loadCheckpoint(current)
+	is.NoErr(err)
+	is.Nil(cp)
+
+	i.waysNeeded.MarkNeeded(42)
+	i.relationCount.Store(3)
+	is.NoErr(i.saveCheckpoint(current, passRelations))
+
+	i = newImporter(env, "man", "man.osm.pbf", nil, "")
+	cp, err = i.loadCheckpoint(current)
+	is.NoErr(err)
+	is.NotNil(cp)
+	is.Equal(cp.Pass, passRelations)
+	is.True(i.waysNeeded.IsNeeded(42))
+	is.Equal(i.relationCount.Load(), int64(3))
+
+	i.nodesNeeded.MarkNeeded(43)
+	is.NoErr(i.saveCheckpoint(cp, passWays))
+	isFile(is, path.Join(folder, "store/import/man/nodes.idx"))
+
+	i = newImporter(env, "man", "man.osm.pbf", nil, "")
+	cp, err = i.loadCheckpoint(current)
+	is.NoErr(err)
+	is.Equal(cp.Pass, passWays)
+	is.True(i.nodesNeeded.IsNeeded(43))
+	is.False(i.waysNeeded.IsNeeded(42))
+
+	// A different file starts over
+	other := *current
+	other.Sequence++
+	i = newImporter(env, "man", "man.osm.pbf", nil, "")
+	cp, err = i.loadCheckpoint(&other)
+	is.NoErr(err)
+	is.Nil(cp)
+	_, err = os.Stat(path.Join(folder, "store/import/man"))
+	is.True(os.IsNotExist(err))
+
+	// So does a different import mode
+	is.NoErr(i.saveCheckpoint(current, passRelations))
+	other = *current
+	other.Mode = ImportSinglePass
+	i = newImporter(env, "man", "man.osm.pbf", nil, "")
+	cp, err = i.loadCheckpoint(&other)
+	is.NoErr(err)
+	is.Nil(cp)
+	_, err = os.Stat(path.Join(folder, "store/import/man"))
+	is.True(os.IsNotExist(err))
+}
+
+func benchmarkImport(b *testing.B, mode string) {
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		folder, err := ioutil.TempDir("", "bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		config := NewConfig()
+		env, err := prepareEnv(config, path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StartTimer()
+		err = env.ImportFileMode("man", "fixtures/geodata/isle-of-man-latest.osm.pbf", mode)
+		b.StopTimer()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		env.Stop()
+		os.RemoveAll(folder)
+	}
+}
+
+func BenchmarkImportMultiPass(b *testing.B) {
+	benchmarkImport(b, ImportMultiPass)
+}
+
+func BenchmarkImportSinglePass(b *testing.B) {
+	benchmarkImport(b, ImportSinglePass)
+}
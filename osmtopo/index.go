@@ -0,0 +1,155 @@
+package osmtopo
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rubenv/osmtopo/osmtopo/lookup"
+	"github.com/tecbot/gorocksdb"
+)
+
+// Location of the persisted lookup index, stored next to the database
+func (e *Env) lookupIndexPath() string {
+	return path.Join(e.storePath, "lookup.idx")
+}
+
+// Identifies the data the lookup index is built from: the replication
+// sequence of each source and the configuration that determines which
+// relations end up in each layer. A persisted index can only be reused when
+// this fingerprint matches.
+//
+// Sources are read from the store rather than the config, files imported by
+// hand don't have to be configured.
+func (e *Env) lookupFingerprint() (string, error) {
+	h := sha1.New()
+	fmt.Fprintf(h, "version %d\n", lookup.IndexVersion)
+	for _, prefix := range [][]byte{intKey("seq/"), flagKey("imported/")} {
+		err := e.hashEntries(h, prefix)
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, layer := range e.config.Layers {
+		fmt.Fprintf(h, "layer %s %v\n", layer.ID, layer.AdminLevels)
+		if len(layer.Filter) > 0 {
+			fmt.Fprintf(h, "filter %s %s\n", layer.ID, layer.Filter)
+		}
+	}
+	fmt.Fprintf(h, "blacklist %v\n", e.config.Blacklist)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Writes all stored entries with the given key prefix to w
+func (e *Env) hashEntries(w io.Writer, prefix []byte) error {
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+
+	it := e.db.NewIterator(ro)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Key()
+		value := it.Value()
+		fmt.Fprintf(w, "%s %s\n", key.Data(), value.Data())
+		key.Free()
+		value.Free()
+	}
+	return it.Err()
+}
+
+// Loads the persisted lookup index if it matches the given fingerprint.
+// Returns false if the index needs to be rebuilt.
+func (e *Env) restoreLookup(fingerprint string) (bool, error) {
+	e.lookupLock.RLock()
+	current := e.lookup != nil && e.lookupKey == fingerprint
+	e.lookupLock.RUnlock()
+	if current {
+		return true, nil
+	}
+
+	data, err := e.readLookupIndex(fingerprint)
+	if err != nil {
+		// Broken index, will be replaced by a fresh one
+		e.log("lookup", "Ignoring persisted index: %s", err)
+		return false, nil
+	}
+	if data == nil {
+		return false, nil
+	}
+
+	e.setLookup(data, fingerprint)
+	e.log("lookup", "Loaded persisted index")
+	return true, nil
+}
+
+func (e *Env) readLookupIndex(fingerprint string) (*lookup.Data, error) {
+	fp, err := os.Open(e.lookupIndexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+
+	r := bufio.NewReader(fp)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(line) != fingerprint {
+		return nil, nil
+	}
+
+	data := lookup.New()
+	_, err = data.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = data.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Writes the lookup index, prefixed with the fingerprint of the data it was
+// built from. The file is replaced atomically.
+func (e *Env) writeLookupIndex(fingerprint string, data *lookup.Data) error {
+	filename := e.lookupIndexPath()
+	tmpFile := filename + ".tmp"
+
+	fp, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+	defer fp.Close()
+
+	_, err = fmt.Fprintln(fp, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	_, err = data.WriteTo(fp)
+	if err != nil {
+		return err
+	}
+
+	err = fp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, filename)
+}
@@ -0,0 +1,119 @@
+package osmtopo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cheekybits/is"
+)
+
+func TestRestoreLookupCorrupt(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, err := prepareEnv(NewConfig(), path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	fingerprint, err := env.lookupFingerprint()
+	is.NoErr(err)
+
+	// A valid header, followed by a layer that claims a huge ID
+	var buf bytes.Buffer
+	buf.WriteString(fingerprint + "\n")
+	buf.WriteString("osmtopoL")
+	binary.Write(&buf, binary.LittleEndian, uint32(1))
+	binary.Write(&buf, binary.LittleEndian, uint32(1))
+	binary.Write(&buf, binary.LittleEndian, uint32(0xffffffff))
+	is.NoErr(ioutil.WriteFile(env.lookupIndexPath(), buf.Bytes(), 0644))
+
+	ok, err := env.restoreLookup(fingerprint)
+	is.NoErr(err)
+	is.False(ok)
+
+	// Loading rebuilds and replaces the broken index
+	is.NoErr(env.loadLookup())
+	is.NotNil(env.lookupIndex(true))
+
+	env.setLookup(nil, "")
+	ok, err = env.restoreLookup(fingerprint)
+	is.NoErr(err)
+	is.True(ok)
+}
+
+func TestLookupUnconfiguredSource(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, err := prepareEnv(NewConfig(), path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	is.NoErr(env.loadLookup())
+	before, err := env.lookupFingerprint()
+	is.NoErr(err)
+
+	// Imported by hand, without being in the config
+	is.NoErr(env.ImportFile("man", "fixtures/geodata/isle-of-man-latest.osm.pbf"))
+	after, err := env.lookupFingerprint()
+	is.NoErr(err)
+	is.NotEqual(before, after)
+
+	// The persisted index is stale and gets rebuilt
+	env.setLookup(nil, "")
+	ok, err := env.restoreLookup(after)
+	is.NoErr(err)
+	is.False(ok)
+	is.NoErr(env.loadLookup())
+	is.Equal(env.lookupKey, after)
+	ok, err = env.restoreLookup(after)
+	is.NoErr(err)
+	is.True(ok)
+}
+
+func TestLookupWhileReloading(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, err := prepareEnv(NewConfig(), path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+	is.NoErr(env.loadLookup())
+
+	// The updater replaces the index while requests query it
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 10; i++ {
+			env.setLookup(nil, "")
+			err := env.loadLookup()
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < 100; i++ {
+		index := env.lookupIndex(true)
+		if index == nil {
+			continue
+		}
+		_, err := env.lookupPoint(index, 54.2, -4.5, nil)
+		is.NoErr(err)
+	}
+	is.NoErr(<-done)
+}
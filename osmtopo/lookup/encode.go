@@ -0,0 +1,219 @@
+package lookup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Identifies a serialized lookup index
+var indexMagic = [8]byte{'o', 's', 'm', 't', 'o', 'p', 'o', 'L'}
+
+// Version of the serialized format, bump when making incompatible changes
+// (this includes changes to the way coverages are computed).
+const IndexVersion = 1
+
+var errNotIndex = errors.New("Not a lookup index")
+
+// Sanity limits for the lengths read from a serialized index, a corrupt file
+// should fail to load rather than exhaust memory.
+const (
+	maxLayers    = 1 << 16
+	maxIDLength  = 256
+	maxIntervals = 1 << 32
+)
+
+// Serializes the indexed cells of all layers.
+//
+// The format is a header (magic and version), followed by each layer: the
+// length-prefixed layer ID, the number of intervals and the intervals
+// themselves as (from, to, id) triples. All numbers are little-endian.
+func (l *Data) WriteTo(w io.Writer) (int64, error) {
+	l.layerLock.Lock()
+	defer l.layerLock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	layerIDs := make([]string, 0, len(l.layers))
+	for id := range l.layers {
+		layerIDs = append(layerIDs, id)
+	}
+	sort.Strings(layerIDs)
+
+	write := func(v interface{}) error {
+		return binary.Write(cw, binary.LittleEndian, v)
+	}
+
+	err := write(indexMagic)
+	if err != nil {
+		return cw.n, err
+	}
+	err = write(uint32(IndexVersion))
+	if err != nil {
+		return cw.n, err
+	}
+	err = write(uint32(len(layerIDs)))
+	if err != nil {
+		return cw.n, err
+	}
+
+	for _, id := range layerIDs {
+		layer := l.layers[id]
+
+		err = write(uint32(len(id)))
+		if err != nil {
+			return cw.n, err
+		}
+		_, err = io.WriteString(cw, id)
+		if err != nil {
+			return cw.n, err
+		}
+
+		count := uint64(0)
+		layer.tree.Walk(func(from, to uint64, element interface{}) error {
+			count++
+			return nil
+		})
+		err = write(count)
+		if err != nil {
+			return cw.n, err
+		}
+
+		var buf [24]byte
+		err = layer.tree.Walk(func(from, to uint64, element interface{}) error {
+			binary.LittleEndian.PutUint64(buf[0:], from)
+			binary.LittleEndian.PutUint64(buf[8:], to)
+			binary.LittleEndian.PutUint64(buf[16:], uint64(element.(int64)))
+			_, err := cw.Write(buf[:])
+			return err
+		})
+		if err != nil {
+			return cw.n, err
+		}
+	}
+
+	return cw.n, bw.Flush()
+}
+
+// Reads a serialized index, as written by WriteTo.
+//
+// The cells are indexed into the (unbuilt) lookup, so Build should be called
+// afterwards.
+func (l *Data) ReadFrom(r io.Reader) (int64, error) {
+	if l.built {
+		return 0, errors.New("Cannot index after building the lookup")
+	}
+
+	cr := &countingReader{r: bufio.NewReader(r)}
+	read := func(v interface{}) error {
+		return binary.Read(cr, binary.LittleEndian, v)
+	}
+
+	var magic [8]byte
+	err := read(&magic)
+	if err != nil {
+		return cr.n, err
+	}
+	if magic != indexMagic {
+		return cr.n, errNotIndex
+	}
+
+	var version uint32
+	err = read(&version)
+	if err != nil {
+		return cr.n, err
+	}
+	if version != IndexVersion {
+		return cr.n, fmt.Errorf("Unsupported lookup index version: %d", version)
+	}
+
+	var layers uint32
+	err = read(&layers)
+	if err != nil {
+		return cr.n, err
+	}
+	if layers > maxLayers {
+		return cr.n, fmt.Errorf("Invalid lookup index layer count: %d", layers)
+	}
+
+	for i := uint32(0); i < layers; i++ {
+		var idLen uint32
+		err = read(&idLen)
+		if err != nil {
+			return cr.n, err
+		}
+		if idLen > maxIDLength {
+			return cr.n, fmt.Errorf("Invalid lookup index layer ID length: %d", idLen)
+		}
+		id := make([]byte, idLen)
+		_, err = io.ReadFull(cr, id)
+		if err != nil {
+			return cr.n, err
+		}
+
+		var count uint64
+		err = read(&count)
+		if err != nil {
+			return cr.n, err
+		}
+		if count > maxIntervals {
+			return cr.n, fmt.Errorf("Invalid lookup index interval count: %d", count)
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		l.layerLock.Lock()
+		layer, ok := l.layers[string(id)]
+		if !ok {
+			layer = newLayer()
+			l.layers[string(id)] = layer
+		}
+		l.layerLock.Unlock()
+
+		var buf [24]byte
+		layer.indexLock.Lock()
+		for j := uint64(0); j < count; j++ {
+			_, err = io.ReadFull(cr, buf[:])
+			if err != nil {
+				layer.indexLock.Unlock()
+				return cr.n, err
+			}
+
+			from := binary.LittleEndian.Uint64(buf[0:])
+			to := binary.LittleEndian.Uint64(buf[8:])
+			relID := int64(binary.LittleEndian.Uint64(buf[16:]))
+			layer.tree.Push(from, to, relID)
+		}
+		layer.indexLock.Unlock()
+	}
+
+	return cr.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
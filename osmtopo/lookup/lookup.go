@@ -154,23 +154,44 @@ func (l *layer) indexCells(id int64, cells s2.CellUnion) {
 
 // Look up all shapes that contain a given point, in a given layer
 func (l *Data) Query(lat, lng float64, layerID string) ([]int64, error) {
+	if _, ok := l.layers[layerID]; !ok {
+		return nil, nil
+	}
+
+	return l.QueryAppend(lat, lng, layerID, make([]int64, 0))
+}
+
+// Buffers for collecting query results, reused to avoid allocations
+var queryBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]interface{}, 0, 16)
+		return &buf
+	},
+}
+
+// Look up all shapes that contain a given point, in a given layer, appending
+// their IDs to dst.
+//
+// Reusing dst between queries avoids allocating a new slice for each query.
+func (l *Data) QueryAppend(lat, lng float64, layerID string, dst []int64) ([]int64, error) {
 	layer, ok := l.layers[layerID]
 	if !ok {
-		return nil, nil
+		return dst, nil
 	}
 
 	cell := s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, lng))
 
-	matches := make([]int64, 0)
-	results, err := layer.tree.QueryIndex(uint64(cell))
-	if err != nil {
-		return nil, err
-	}
-	for r := range results {
-		matches = append(matches, r.(int64))
+	buf := queryBuffers.Get().(*[]interface{})
+	results, err := layer.tree.QueryAppend(uint64(cell), (*buf)[:0])
+	if err == nil {
+		for _, r := range results {
+			dst = append(dst, r.(int64))
+		}
 	}
+	*buf = results[:0]
+	queryBuffers.Put(buf)
 
-	return matches, nil
+	return dst, err
 }
 
 func MakeCells(poly [][][]float64) (s2.CellUnion, error) {
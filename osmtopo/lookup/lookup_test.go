@@ -1,8 +1,11 @@
 package lookup
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/cheekybits/is"
@@ -79,4 +82,88 @@ func TestLookupCities(t *testing.T) {
 		}
 	}
 	is.True(found)
+
+	// Appending keeps the existing IDs and returns the same matches
+	appended, err := l.QueryAppend(54.1504053, -4.4776897, "cities", []int64{1})
+	is.NoErr(err)
+	is.Equal(len(appended), len(ids)+1)
+	is.Equal(appended[0], int64(1))
+	is.Equal(appended[1:], ids)
+}
+
+func TestLookupSerialize(t *testing.T) {
+	is := is.New(t)
+
+	fp, err := os.Open("fixtures/cities.topojson")
+	is.NoErr(err)
+	defer fp.Close()
+
+	topo := &topojson.Topology{}
+	err = json.NewDecoder(fp).Decode(topo)
+	is.NoErr(err)
+
+	l := New()
+	err = l.IndexFeatures("cities", topo.ToGeoJSON())
+	is.NoErr(err)
+	err = l.Build()
+	is.NoErr(err)
+
+	var buf bytes.Buffer
+	n, err := l.WriteTo(&buf)
+	is.NoErr(err)
+	is.Equal(n, int64(buf.Len()))
+
+	l2 := New()
+	m, err := l2.ReadFrom(&buf)
+	is.NoErr(err)
+	is.Equal(m, n)
+	err = l2.Build()
+	is.NoErr(err)
+
+	ids, err := l.Query(54.1504053, -4.4776897, "cities")
+	is.NoErr(err)
+	ids2, err := l2.Query(54.1504053, -4.4776897, "cities")
+	is.NoErr(err)
+	is.True(len(ids) > 0)
+	is.Equal(ids, ids2)
+
+	// Garbage is rejected
+	_, err = New().ReadFrom(strings.NewReader("not an index, certainly"))
+	is.Err(err)
+}
+
+func TestLookupSerializeCorrupt(t *testing.T) {
+	is := is.New(t)
+
+	header := func(buf *bytes.Buffer) {
+		buf.Write(indexMagic[:])
+		binary.Write(buf, binary.LittleEndian, uint32(IndexVersion))
+		binary.Write(buf, binary.LittleEndian, uint32(1))
+	}
+
+	// Oversized layer ID
+	var buf bytes.Buffer
+	header(&buf)
+	binary.Write(&buf, binary.LittleEndian, uint32(1<<31))
+	_, err := New().ReadFrom(&buf)
+	is.Err(err)
+
+	// Oversized interval count
+	buf.Reset()
+	header(&buf)
+	binary.Write(&buf, binary.LittleEndian, uint32(6))
+	buf.WriteString("cities")
+	binary.Write(&buf, binary.LittleEndian, uint64(1<<62))
+	_, err = New().ReadFrom(&buf)
+	is.Err(err)
+
+	// Truncated intervals
+	buf.Reset()
+	header(&buf)
+	binary.Write(&buf, binary.LittleEndian, uint32(6))
+	buf.WriteString("cities")
+	binary.Write(&buf, binary.LittleEndian, uint64(2))
+	buf.Write(make([]byte, 30))
+	_, err = New().ReadFrom(&buf)
+	is.Err(err)
 }
@@ -0,0 +1,88 @@
+package segtree_test
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/golang/geo/s2"
+	"github.com/rubenv/osmtopo/osmtopo/lookup"
+	"github.com/rubenv/osmtopo/osmtopo/lookup/segtree"
+	"github.com/rubenv/topojson"
+)
+
+// Builds a tree from the S2 coverages of the cities fixture, together with a
+// set of query points that fall within its bounds.
+func loadCities(b *testing.B) (*segtree.Tree, []uint64) {
+	fp, err := os.Open("../fixtures/cities.topojson")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fp.Close()
+
+	topo := &topojson.Topology{}
+	err = json.NewDecoder(fp).Decode(topo)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tree := new(segtree.Tree)
+	rect := s2.EmptyRect()
+	for _, feat := range topo.ToGeoJSON().Features {
+		coverage, err := lookup.GeometryToCoverage(feat.Geometry)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, cells := range coverage {
+			for _, cell := range cells {
+				tree.Push(uint64(cell.RangeMin()), uint64(cell.RangeMax()), feat.ID)
+				rect = rect.Union(s2.CellFromCellID(cell).RectBound())
+			}
+		}
+	}
+	err = tree.BuildTree()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	points := make([]uint64, 1024)
+	for i := range points {
+		lat := rect.Lo().Lat.Degrees() + r.Float64()*rect.Size().Lat.Degrees()
+		lng := rect.Lo().Lng.Degrees() + r.Float64()*rect.Size().Lng.Degrees()
+		points[i] = uint64(s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, lng)))
+	}
+
+	return tree, points
+}
+
+func BenchmarkQueryIndex(b *testing.B) {
+	tree, points := loadCities(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		results, err := tree.QueryIndex(points[i%len(points)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range results {
+		}
+	}
+}
+
+func BenchmarkQueryAppend(b *testing.B) {
+	tree, points := loadCities(b)
+
+	var results []interface{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		results, err = tree.QueryAppend(points[i%len(points)], results[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
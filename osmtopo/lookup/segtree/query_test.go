@@ -245,6 +245,61 @@ func TestFindingSameElementTwice(t *testing.T) {
 	}
 }
 
+func TestQueryAppend(t *testing.T) {
+	tree := new(Tree)
+	tree.Push(1, 10, "one")
+	tree.Push(5, 15, "two")
+	tree.Push(8, 12, "one")
+	tree.BuildTree()
+
+	// Existing elements in dst are kept
+	dst := []interface{}{"zero"}
+	results, err := tree.QueryAppend(9, dst)
+	if err != nil {
+		queryFailed(t, err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 elements, got %v\n", results)
+	}
+	if results[0] != "zero" {
+		wrongElement(t, results[0], "zero")
+	}
+
+	tests := []interface{}{"one", "two"}
+	for _, result := range results[1:] {
+		found, index := find(result, tests)
+		if !found {
+			receivedUnexpected(t, result)
+		}
+		tests[index], tests = tests[len(tests)-1], tests[:len(tests)-1]
+	}
+
+	// Reusing the buffer
+	results, err = tree.QueryAppend(14, results[:0])
+	if err != nil {
+		queryFailed(t, err)
+	}
+	if len(results) != 1 || results[0] != "two" {
+		t.Errorf("Expected [two], got %v\n", results)
+	}
+
+	results, err = tree.QueryAppend(20, results[:0])
+	if err != nil {
+		queryFailed(t, err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected no elements, got %v\n", results)
+	}
+}
+
+func TestQueryAppendEmptyTree(t *testing.T) {
+	tree := new(Tree)
+	_, err := tree.QueryAppend(4, nil)
+	if err == nil {
+		t.Error("Expected an error when querying an empty tree")
+	}
+}
+
 // Some frequently used errors
 
 func queryFailed(t *testing.T, err error) {
@@ -50,6 +50,18 @@ func (t *Tree) Push(from, to uint64, element interface{}) {
 	t.base = append(t.base, interval{segment{from, to}, element})
 }
 
+// Walk calls fn for each interval on the interval stack, in the order in
+// which they were pushed
+func (t *Tree) Walk(fn func(from, to uint64, element interface{}) error) error {
+	for _, interval := range t.base {
+		err := fn(interval.from, interval.to, interval.element)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Clear clears the interval stack
 func (t *Tree) Clear() {
 	t.root = nil
@@ -207,6 +219,21 @@ func (t *Tree) QueryIndex(index uint64) (<-chan interface{}, error) {
 	return elements, nil
 }
 
+// QueryAppend looks for all segments in the tree that contain a given index
+// and appends the associated elements to dst, returning the extended slice.
+// Like QueryIndex, no element will be returned twice and the elements are not
+// in any specific order.
+//
+// Unlike QueryIndex, the query runs synchronously and does not allocate,
+// unless dst needs to grow. Reuse dst between queries to benefit from this.
+func (t *Tree) QueryAppend(index uint64, dst []interface{}) ([]interface{}, error) {
+	if t.root == nil {
+		return dst, errors.New("Tree is empty. Build the tree first")
+	}
+
+	return queryAppend(t.root, index, dst, len(dst)), nil
+}
+
 func (s segment) contains(index uint64) bool {
 	return s.from <= index && index <= s.to
 }
@@ -224,3 +251,33 @@ func query(node *node, index uint64, results chan<- *interval) {
 		}
 	}
 }
+
+// Appends the elements of all intervals containing index to dst, skipping
+// elements that were already added since start.
+func queryAppend(node *node, index uint64, dst []interface{}, start int) []interface{} {
+	if !node.segment.contains(index) {
+		return dst
+	}
+
+	for _, interval := range node.intervals {
+		// Few segments overlap at a given index, a linear scan is cheaper
+		// than keeping a set.
+		found := false
+		for _, element := range dst[start:] {
+			if element == interval.element {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, interval.element)
+		}
+	}
+	if node.left != nil {
+		dst = queryAppend(node.left, index, dst, start)
+	}
+	if node.right != nil {
+		dst = queryAppend(node.right, index, dst, start)
+	}
+	return dst
+}
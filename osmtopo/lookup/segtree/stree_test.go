@@ -32,3 +32,31 @@ func TestClearingTree(t *testing.T) {
 		t.Error("Failed to clear tree, it was possible to query the tree")
 	}
 }
+
+func TestWalk(t *testing.T) {
+	tree := new(Tree)
+	tree.Push(1, 10, "one")
+	tree.Push(15, 5, "two")
+
+	var seen []interval
+	err := tree.Walk(func(from, to uint64, element interface{}) error {
+		seen = append(seen, interval{segment{from, to}, element})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interval{
+		{segment{1, 10}, "one"},
+		{segment{5, 15}, "two"},
+	}
+	if len(seen) != len(expected) {
+		t.Fatalf("Expected %d intervals, got %d", len(expected), len(seen))
+	}
+	for i := range expected {
+		if seen[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], seen[i])
+		}
+	}
+}
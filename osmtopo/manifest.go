@@ -0,0 +1,143 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/rubenv/topojson"
+)
+
+const manifestFile = "manifest.json"
+
+// Index of all exported layers, written to the root of the output folder
+type Manifest struct {
+	Layers []*ManifestLayer `json:"layers"`
+}
+
+type ManifestLayer struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Features int    `json:"features"`
+	Slices   int    `json:"slices"`
+
+	// Path of the layer manifest, relative to the output folder. Not set
+	// when the layer failed to export.
+	Manifest string `json:"manifest,omitempty"`
+
+	// Why the layer failed to export, its files should not be used
+	Error string `json:"error,omitempty"`
+}
+
+// Describes the slices of a layer, written next to the slices. Lets clients
+// find the slices they need without downloading all of them.
+type LayerManifest struct {
+	ID     string           `json:"id"`
+	Name   string           `json:"name"`
+	Slices []*SliceManifest `json:"slices"`
+
+	// Single-file outputs by format, relative to the layer manifest
+	Files map[string]string `json:"files,omitempty"`
+
+	// Fingerprint of the configuration that shaped the features (names,
+	// properties, ...). Incremental exports re-slice everything when it
+	// changes.
+	Config string `json:"config,omitempty"`
+}
+
+type SliceManifest struct {
+	// Filename of the slice, relative to the layer manifest
+	File string `json:"file"`
+
+	// Bounding box of all features in the slice: [min lon, min lat, max lon, max lat]
+	BoundingBox []float64 `json:"bbox"`
+
+	Points   int                `json:"points"`
+	Features []*FeatureManifest `json:"features"`
+}
+
+type FeatureManifest struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// Feature IDs in a slice
+func (s *SliceManifest) IDs() []string {
+	result := make([]string, len(s.Features))
+	for i, f := range s.Features {
+		result[i] = f.ID
+	}
+	return result
+}
+
+func newSliceManifest(topo *topojson.Topology, slice int, ids []string) *SliceManifest {
+	result := &SliceManifest{
+		File:     fmt.Sprintf("%04d.topojson", slice),
+		Features: make([]*FeatureManifest, 0, len(ids)),
+	}
+
+	bbox := newBoundingBox()
+	for _, id := range ids {
+		obj := topo.Objects[id]
+
+		feature := &FeatureManifest{
+			ID: id,
+		}
+		if name, ok := obj.Properties["name"].(string); ok {
+			feature.Name = name
+		}
+		result.Features = append(result.Features, feature)
+
+		result.Points += countPoints(topo, obj)
+		if len(obj.BoundingBox) == 4 {
+			bbox.extend(boundingBox(obj.BoundingBox))
+		}
+	}
+	result.BoundingBox = []float64(bbox)
+
+	return result
+}
+
+// Reads the manifest of a layer, nil if there is none
+func readLayerManifest(folder string) (*LayerManifest, error) {
+	fp, err := os.Open(path.Join(folder, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	manifest := &LayerManifest{}
+	err = json.NewDecoder(fp).Decode(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Replaces the manifest in one go, readers never see a partial file
+func writeManifest(folder string, manifest interface{}) error {
+	filename := path.Join(folder, manifestFile)
+	tmp := filename + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(fp)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	err = fp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
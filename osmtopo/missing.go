@@ -31,17 +31,11 @@ func (e *Env) importMissing(in io.Reader) error {
 
 	toAdd := make([]*model.MissingCoordinate, 0)
 	for _, m := range missing {
-		complete := true
-		for _, layer := range e.config.Layers {
-			matches, err := e.queryLookup(e.topologies, m.Lat, m.Lon, layer.ID)
-			if err != nil {
-				return err
-			}
-			if len(matches) == 0 {
-				complete = false
-			}
+		matched, err := e.matchTopologies(m.Lat, m.Lon)
+		if err != nil {
+			return err
 		}
-		if !complete {
+		if len(matched) < len(e.config.Layers) {
 			toAdd = append(toAdd, m)
 		}
 	}
@@ -56,10 +50,48 @@ func (e *Env) importMissing(in io.Reader) error {
 		return err
 	}
 
-	e.Status.Missing = c
+	e.setMissing(c)
 	return nil
 }
 
+// Finds the selected topology that contains a point, for each layer.
+//
+// Matches that aren't allowed by the matching rules are left out, as they
+// should be replaced by a better match.
+func (e *Env) matchTopologies(lat, lon float64) (map[string]*model.Relation, error) {
+	topologies := e.lookupIndex(false)
+	matched := make(map[string]*model.Relation)
+	ids := make(map[string]int64)
+	for _, layer := range e.config.Layers {
+		matches, err := e.queryLookup(topologies, lat, lon, layer.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Query topologies: %s", err)
+		}
+		if len(matches) == 0 {
+			continue
+		}
+
+		rel, err := e.GetRelation(matches[0])
+		if err != nil {
+			return nil, err
+		}
+		if rel == nil {
+			return nil, fmt.Errorf("Cannot find relation for match %d", matches[0])
+		}
+
+		matched[layer.ID] = rel
+		ids[layer.ID] = rel.Id
+	}
+
+	for layer, rel := range matched {
+		if !e.config.Allows(ids, layer, rel.GetAdminLevel()) {
+			delete(matched, layer)
+		}
+	}
+
+	return matched, nil
+}
+
 func (e *Env) getMissingCoordinate() (*CoordinateInfo, error) {
 	c, err := e.getMissing()
 	if err != nil {
@@ -77,59 +109,61 @@ func (e *Env) getMissingCoordinate() (*CoordinateInfo, error) {
 		MatchID:     make(map[string]int64),
 	}
 
+	matched, err := e.matchTopologies(c.Lat, c.Lon)
+	if err != nil {
+		return nil, err
+	}
+	for layer, rel := range matched {
+		name, _ := rel.GetTag("name")
+		info.Matched[layer] = true
+		info.MatchName[layer] = name
+		info.MatchID[layer] = rel.Id
+	}
+
+	index := e.lookupIndex(true)
 	complete := true
 	for _, layer := range e.config.Layers {
-		matches, err := e.queryLookup(e.topologies, c.Lat, c.Lon, layer.ID)
-		if err != nil {
-			return nil, fmt.Errorf("Query topologies: %s", err)
+		if info.Matched[layer.ID] {
+			continue
 		}
-		if len(matches) == 0 {
-			complete = false
+		complete = false
 
-			suggestions := make([]*RelationSuggestion, 0)
-			matches, err := e.queryLookup(e.lookup, c.Lat, c.Lon, layer.ID)
-			if err != nil {
-				return nil, fmt.Errorf("Query lookup: %s", err)
-			}
-			for _, match := range matches {
-				rel, err := e.GetRelation(match)
-				if err != nil {
-					return nil, err
-				}
-				if rel == nil {
-					return nil, fmt.Errorf("Cannot find relation for match %d", match)
-				}
-
-				name, _ := rel.GetTag("name")
-				admin_level := rel.GetAdminLevel()
-				suggestions = append(suggestions, &RelationSuggestion{
-					ID:         match,
-					Name:       name,
-					AdminLevel: admin_level,
-				})
-			}
-			info.Suggestions[layer.ID] = suggestions
-		} else {
-			rel, err := e.GetRelation(matches[0])
+		suggestions := make([]*RelationSuggestion, 0)
+		matches, err := e.queryLookup(index, c.Lat, c.Lon, layer.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Query lookup: %s", err)
+		}
+		for _, match := range matches {
+			rel, err := e.GetRelation(match)
 			if err != nil {
 				return nil, err
 			}
 			if rel == nil {
-				return nil, fmt.Errorf("Cannot find relation for match %d", matches[0])
+				return nil, fmt.Errorf("Cannot find relation for match %d", match)
 			}
 
 			name, _ := rel.GetTag("name")
-			info.Matched[layer.ID] = true
-			info.MatchName[layer.ID] = name
-			info.MatchID[layer.ID] = rel.Id
+			admin_level := rel.GetAdminLevel()
+
+			// Skip suggestions that would violate the matching rules
+			if !e.config.Allows(info.MatchID, layer.ID, admin_level) {
+				continue
+			}
+
+			suggestions = append(suggestions, &RelationSuggestion{
+				ID:         match,
+				Name:       name,
+				AdminLevel: admin_level,
+			})
 		}
+		info.Suggestions[layer.ID] = suggestions
 	}
 	if complete {
 		err = e.removeMissing(c)
 		if err != nil {
 			return nil, err
 		}
-		e.Status.Missing--
+		e.missingResolved()
 
 		return e.getMissingCoordinate()
 	}
@@ -0,0 +1,119 @@
+package mvt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Writes tiles to an MBTiles file (https://github.com/mapbox/mbtiles-spec).
+// Tiles are stored gzipped, as is customary for vector tiles.
+type MBTiles struct {
+	db *sql.DB
+	tx *sql.Tx
+	st *sql.Stmt
+}
+
+// Creates a new MBTiles file, replacing any existing file. The metadata
+// should at least contain the name of the tileset.
+func CreateMBTiles(filename string, metadata map[string]string) (*MBTiles, error) {
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := initMBTiles(db, metadata)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func initMBTiles(db *sql.DB, metadata map[string]string) (*MBTiles, error) {
+	stmts := []string{
+		"CREATE TABLE metadata (name TEXT, value TEXT)",
+		"CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+		"CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row)",
+	}
+	for _, stmt := range stmts {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]string{
+		"format": "pbf",
+	}
+	for k, v := range metadata {
+		meta[k] = v
+	}
+	for k, v := range meta {
+		_, err := tx.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", k, v)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	st, err := tx.Prepare("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &MBTiles{
+		db: db,
+		tx: tx,
+		st: st,
+	}, nil
+}
+
+// Stores an encoded tile
+func (m *MBTiles) WriteTile(tile Tile, data []byte) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = m.st.Exec(tile.Z, tile.X, tile.TMSRow(), buf.Bytes())
+	return err
+}
+
+// Commits all tiles and closes the file
+func (m *MBTiles) Close() error {
+	m.st.Close()
+	err := m.tx.Commit()
+	if err != nil {
+		m.db.Close()
+		return err
+	}
+	return m.db.Close()
+}
+
+// Closes the file without committing, for when writing failed
+func (m *MBTiles) Abort() error {
+	m.st.Close()
+	m.tx.Rollback()
+	return m.db.Close()
+}
@@ -0,0 +1,298 @@
+// Package mvt encodes Mapbox Vector Tiles
+// (https://github.com/mapbox/vector-tile-spec) and writes them to MBTiles
+// files.
+//
+// Only polygons are supported, which is all osmtopo produces.
+package mvt
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// Default tile extent, in tile units
+const Extent = 4096
+
+const version = 2
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Geometry commands
+const (
+	cmdMoveTo    = 1
+	cmdLineTo    = 2
+	cmdClosePath = 7
+)
+
+const geomPolygon = 3
+
+// A single layer of a tile
+type Layer struct {
+	Name   string
+	Extent int
+
+	tile     Tile
+	features []*feature
+	keys     []string
+	keyIndex map[string]int
+	values   []interface{}
+	valIndex map[interface{}]int
+}
+
+type feature struct {
+	ID       uint64
+	Tags     []uint32
+	Geometry []uint32
+}
+
+func NewLayer(name string, tile Tile) *Layer {
+	return &Layer{
+		Name:     name,
+		Extent:   Extent,
+		tile:     tile,
+		keyIndex: make(map[string]int),
+		valIndex: make(map[interface{}]int),
+	}
+}
+
+// Number of features in the layer
+func (l *Layer) Len() int {
+	return len(l.features)
+}
+
+// Adds a (multi)polygon to the layer, given as a list of polygons in
+// longitude/latitude. Each polygon consists of an outer ring, followed by its
+// holes.
+//
+// Coordinates are projected into the tile and rounded. Rings that become
+// degenerate by doing so are dropped, ring orientation is fixed as needed.
+// Returns false if nothing remained to add.
+func (l *Layer) AddPolygons(id uint64, properties map[string]interface{}, polygons [][][][]float64) (bool, error) {
+	geometry := make([]uint32, 0)
+	cx, cy := 0, 0
+	for _, poly := range polygons {
+		for i, ring := range poly {
+			points := l.projectRing(ring)
+			area := ringArea(points)
+			if area == 0 {
+				if i == 0 {
+					// Outer ring collapsed, so did the holes
+					break
+				}
+				continue
+			}
+
+			// Outer rings are clockwise (positive area, given that Y
+			// points down), holes are counter-clockwise
+			if (i == 0) != (area > 0) {
+				reversePoints(points)
+			}
+
+			geometry = append(geometry, command(cmdMoveTo, 1))
+			geometry = append(geometry, zigzag(points[0][0]-cx), zigzag(points[0][1]-cy))
+			cx, cy = points[0][0], points[0][1]
+
+			geometry = append(geometry, command(cmdLineTo, len(points)-1))
+			for _, p := range points[1:] {
+				geometry = append(geometry, zigzag(p[0]-cx), zigzag(p[1]-cy))
+				cx, cy = p[0], p[1]
+			}
+
+			geometry = append(geometry, command(cmdClosePath, 1))
+		}
+	}
+	if len(geometry) == 0 {
+		return false, nil
+	}
+
+	tags, err := l.tags(properties)
+	if err != nil {
+		return false, err
+	}
+
+	l.features = append(l.features, &feature{
+		ID:       id,
+		Tags:     tags,
+		Geometry: geometry,
+	})
+	return true, nil
+}
+
+// Projects a ring into the tile, without the closing point and without
+// repeated points
+func (l *Layer) projectRing(ring [][]float64) [][2]int {
+	result := make([][2]int, 0, len(ring))
+	for _, c := range ring {
+		x, y := l.tile.Project(c[0], c[1], l.Extent)
+		p := [2]int{int(math.Round(x)), int(math.Round(y))}
+		if len(result) > 0 && result[len(result)-1] == p {
+			continue
+		}
+		result = append(result, p)
+	}
+	for len(result) > 1 && result[0] == result[len(result)-1] {
+		result = result[:len(result)-1]
+	}
+	return result
+}
+
+func (l *Layer) tags(properties map[string]interface{}) ([]uint32, error) {
+	keys := make([]string, 0, len(properties))
+	for k, v := range properties {
+		if v != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]uint32, 0, len(keys)*2)
+	for _, k := range keys {
+		v := properties[k]
+		switch n := v.(type) {
+		case string, float64, int64, bool:
+		case int:
+			v = int64(n)
+		case float32:
+			v = float64(n)
+		default:
+			return nil, fmt.Errorf("Unsupported value for property %s: %T", k, v)
+		}
+
+		ki, ok := l.keyIndex[k]
+		if !ok {
+			ki = len(l.keys)
+			l.keys = append(l.keys, k)
+			l.keyIndex[k] = ki
+		}
+
+		vi, ok := l.valIndex[v]
+		if !ok {
+			vi = len(l.values)
+			l.values = append(l.values, v)
+			l.valIndex[v] = vi
+		}
+
+		result = append(result, uint32(ki), uint32(vi))
+	}
+	return result, nil
+}
+
+func (l *Layer) encode() []byte {
+	b := proto.NewBuffer(nil)
+
+	encodeString(b, 1, l.Name)
+	for _, f := range l.features {
+		encodeBytes(b, 2, f.encode())
+	}
+	for _, k := range l.keys {
+		encodeString(b, 3, k)
+	}
+	for _, v := range l.values {
+		encodeBytes(b, 4, encodeValue(v))
+	}
+	encodeVarint(b, 5, uint64(l.Extent))
+	encodeVarint(b, 15, version)
+
+	return b.Bytes()
+}
+
+func (f *feature) encode() []byte {
+	b := proto.NewBuffer(nil)
+	encodeVarint(b, 1, f.ID)
+	encodePacked(b, 2, f.Tags)
+	encodeVarint(b, 3, geomPolygon)
+	encodePacked(b, 4, f.Geometry)
+	return b.Bytes()
+}
+
+func encodeValue(v interface{}) []byte {
+	b := proto.NewBuffer(nil)
+	switch n := v.(type) {
+	case string:
+		encodeString(b, 1, n)
+	case float64:
+		b.EncodeVarint(uint64(3<<3 | wireFixed64))
+		b.EncodeFixed64(math.Float64bits(n))
+	case int64:
+		encodeVarint(b, 4, uint64(n))
+	case bool:
+		if n {
+			encodeVarint(b, 7, 1)
+		} else {
+			encodeVarint(b, 7, 0)
+		}
+	}
+	return b.Bytes()
+}
+
+// Encodes a tile with the given layers. Empty layers are left out.
+func Encode(layers ...*Layer) []byte {
+	b := proto.NewBuffer(nil)
+	for _, l := range layers {
+		if l.Len() == 0 {
+			continue
+		}
+		encodeBytes(b, 3, l.encode())
+	}
+	return b.Bytes()
+}
+
+func encodeVarint(b *proto.Buffer, field int, v uint64) {
+	b.EncodeVarint(uint64(field<<3 | wireVarint))
+	b.EncodeVarint(v)
+}
+
+func encodeBytes(b *proto.Buffer, field int, v []byte) {
+	b.EncodeVarint(uint64(field<<3 | wireBytes))
+	b.EncodeRawBytes(v)
+}
+
+func encodeString(b *proto.Buffer, field int, v string) {
+	encodeBytes(b, field, []byte(v))
+}
+
+func encodePacked(b *proto.Buffer, field int, v []uint32) {
+	packed := proto.NewBuffer(nil)
+	for _, i := range v {
+		packed.EncodeVarint(uint64(i))
+	}
+	encodeBytes(b, field, packed.Bytes())
+}
+
+func command(id, count int) uint32 {
+	return uint32(id&0x7) | uint32(count)<<3
+}
+
+func zigzag(v int) uint32 {
+	return uint32((int32(v) << 1) ^ (int32(v) >> 31))
+}
+
+// Twice the signed area of a ring, positive when clockwise in tile
+// coordinates
+func ringArea(points [][2]int) int64 {
+	if len(points) < 3 {
+		return 0
+	}
+
+	result := int64(0)
+	for i := range points {
+		p1 := points[i]
+		p2 := points[(i+1)%len(points)]
+		result += int64(p1[0])*int64(p2[1]) - int64(p2[0])*int64(p1[1])
+	}
+	return result
+}
+
+func reversePoints(points [][2]int) {
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+}
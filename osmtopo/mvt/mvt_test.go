@@ -0,0 +1,204 @@
+package mvt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cheekybits/is"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestTile(t *testing.T) {
+	is := is.New(t)
+
+	root := Tile{Z: 0, X: 0, Y: 0}
+	is.True(root.Valid())
+	is.False(Tile{Z: 1, X: 2, Y: 0}.Valid())
+	is.Equal(Tile{Z: 2, X: 1, Y: 0}.TMSRow(), 3)
+
+	x, y := root.Project(0, 0, Extent)
+	is.Equal(x, float64(Extent/2))
+	is.Equal(y, float64(Extent/2))
+
+	bounds := root.Bounds(0, Extent)
+	is.Equal(bounds[0], -180.0)
+	is.Equal(bounds[2], 180.0)
+	is.True(math.Abs(bounds[1]+MaxLatitude) < 1e-9)
+	is.True(math.Abs(bounds[3]-MaxLatitude) < 1e-9)
+
+	// Brussels
+	tiles := TilesCovering(10, []float64{4.35, 50.84, 4.36, 50.85})
+	is.Equal(tiles, []Tile{{Z: 10, X: 524, Y: 343}})
+
+	bounds = tiles[0].Bounds(0, Extent)
+	is.True(bounds[0] <= 4.35 && bounds[2] >= 4.36)
+	is.True(bounds[1] <= 50.84 && bounds[3] >= 50.85)
+
+	// Buffers extend the bounds
+	buffered := tiles[0].Bounds(64, Extent)
+	is.True(buffered[0] < bounds[0])
+	is.True(buffered[3] > bounds[3])
+
+	is.Equal(len(TilesCovering(1, []float64{-10, -10, 10, 10})), 4)
+
+	minX, minY, maxX, maxY := TileRange(1, []float64{-10, -10, 10, 10})
+	is.Equal([]int{minX, minY, maxX, maxY}, []int{0, 0, 1, 1})
+
+	// Empty bounds cover nothing
+	empty := []float64{math.MaxFloat64, math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64}
+	is.Equal(len(TilesCovering(12, empty)), 0)
+}
+
+func decodePacked(data []byte) []uint64 {
+	b := proto.NewBuffer(data)
+	result := make([]uint64, 0)
+	for {
+		v, err := b.DecodeVarint()
+		if err != nil {
+			return result
+		}
+		result = append(result, v)
+	}
+}
+
+// Minimal decoder: returns the raw fields of a message by field number
+func decodeFields(is is.I, data []byte) map[int][][]byte {
+	result := make(map[int][][]byte)
+	b := proto.NewBuffer(data)
+	for {
+		key, err := b.DecodeVarint()
+		if err != nil {
+			return result
+		}
+
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, err := b.DecodeVarint()
+			is.NoErr(err)
+			result[field] = append(result[field], proto.EncodeVarint(v))
+		case wireFixed64:
+			v, err := b.DecodeFixed64()
+			is.NoErr(err)
+			result[field] = append(result[field], proto.EncodeVarint(v))
+		case wireBytes:
+			v, err := b.DecodeRawBytes(true)
+			is.NoErr(err)
+			result[field] = append(result[field], v)
+		default:
+			is.Fail("Unexpected wire type")
+		}
+	}
+}
+
+func varint(data []byte) uint64 {
+	v, _ := proto.NewBuffer(data).DecodeVarint()
+	return v
+}
+
+func TestEncode(t *testing.T) {
+	is := is.New(t)
+
+	tile := Tile{Z: 0, X: 0, Y: 0}
+	layer := NewLayer("regions", tile)
+
+	// Counter-clockwise outer ring (in lon/lat), gets reversed
+	square := [][]float64{{0, 0}, {90, 0}, {90, 45}, {0, 45}, {0, 0}}
+	ok, err := layer.AddPolygons(1234, map[string]interface{}{
+		"id":   "1234",
+		"name": "Square",
+	}, [][][][]float64{{square}})
+	is.NoErr(err)
+	is.True(ok)
+
+	// Too small to show up
+	tiny := [][]float64{{0, 0}, {0.001, 0}, {0.001, 0.001}, {0, 0}}
+	ok, err = layer.AddPolygons(5678, nil, [][][][]float64{{tiny}})
+	is.NoErr(err)
+	is.False(ok)
+	is.Equal(layer.Len(), 1)
+
+	data := Encode(layer, NewLayer("empty", tile))
+
+	fields := decodeFields(is, data)
+	is.Equal(len(fields[3]), 1)
+
+	l := decodeFields(is, fields[3][0])
+	is.Equal(string(l[1][0]), "regions")
+	is.Equal(varint(l[5][0]), uint64(Extent))
+	is.Equal(varint(l[15][0]), uint64(2))
+	is.Equal(len(l[3]), 2)
+	is.Equal(string(l[3][0]), "id")
+	is.Equal(string(l[3][1]), "name")
+	is.Equal(len(l[4]), 2)
+	is.Equal(string(decodeFields(is, l[4][1])[1][0]), "Square")
+
+	is.Equal(len(l[2]), 1)
+	f := decodeFields(is, l[2][0])
+	is.Equal(varint(f[1][0]), uint64(1234))
+	is.Equal(varint(f[3][0]), uint64(geomPolygon))
+	is.Equal(decodePacked(f[2][0]), []uint64{0, 0, 1, 1})
+
+	geom := decodePacked(f[4][0])
+	is.Equal(len(geom), 1+2+1+6+1)
+	is.Equal(geom[0], uint64(command(cmdMoveTo, 1)))
+	is.Equal(geom[3], uint64(command(cmdLineTo, 3)))
+	is.Equal(geom[10], uint64(command(cmdClosePath, 1)))
+
+	// Decode the ring and check that it's clockwise
+	unzigzag := func(v uint64) int {
+		return int(int64(v>>1) ^ -int64(v&1))
+	}
+	points := make([][2]int, 0)
+	x, y := 0, 0
+	for _, i := range []int{1, 4, 6, 8} {
+		x += unzigzag(geom[i])
+		y += unzigzag(geom[i+1])
+		points = append(points, [2]int{x, y})
+	}
+	is.True(ringArea(points) > 0)
+	is.Equal(points[3], [2]int{2048, 2048})
+}
+
+func TestMBTiles(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	filename := path.Join(folder, "test.mbtiles")
+	m, err := CreateMBTiles(filename, map[string]string{
+		"name": "test",
+	})
+	is.NoErr(err)
+
+	tile := Tile{Z: 2, X: 1, Y: 0}
+	is.NoErr(m.WriteTile(tile, []byte("data")))
+	is.NoErr(m.Close())
+
+	db, err := sql.Open("sqlite3", filename)
+	is.NoErr(err)
+	defer db.Close()
+
+	var format string
+	err = db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&format)
+	is.NoErr(err)
+	is.Equal(format, "pbf")
+
+	var data []byte
+	err = db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = 2 AND tile_column = 1 AND tile_row = 3").Scan(&data)
+	is.NoErr(err)
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	is.NoErr(err)
+	unzipped, err := ioutil.ReadAll(gz)
+	is.NoErr(err)
+	is.Equal(string(unzipped), "data")
+}
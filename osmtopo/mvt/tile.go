@@ -0,0 +1,104 @@
+package mvt
+
+import (
+	"fmt"
+	"math"
+)
+
+// Web Mercator can't represent the poles, latitudes are clamped to this
+const MaxLatitude = 85.05112877980659
+
+// Tile in the XYZ (Google) scheme: the origin is at the top left.
+type Tile struct {
+	Z int
+	X int
+	Y int
+}
+
+func (t Tile) String() string {
+	return fmt.Sprintf("%d/%d/%d", t.Z, t.X, t.Y)
+}
+
+func (t Tile) Valid() bool {
+	n := 1 << uint(t.Z)
+	return t.Z >= 0 && t.Z <= 30 && t.X >= 0 && t.X < n && t.Y >= 0 && t.Y < n
+}
+
+// Row of the tile in the TMS scheme (as used by MBTiles), which has its
+// origin at the bottom left
+func (t Tile) TMSRow() int {
+	return (1 << uint(t.Z)) - 1 - t.Y
+}
+
+// Converts coordinates to the position within the tile, in tile units (0 to
+// extent). Points outside of the tile map to positions outside that range.
+func (t Tile) Project(lon, lat float64, extent int) (float64, float64) {
+	x, y := project(lon, lat)
+	scale := float64(int(1)<<uint(t.Z)) * float64(extent)
+	return x*scale - float64(t.X*extent), y*scale - float64(t.Y*extent)
+}
+
+// Bounding box of the tile, extended by a buffer (in tile units) on each
+// side: [min lon, min lat, max lon, max lat]
+func (t Tile) Bounds(buffer, extent int) []float64 {
+	scale := float64(int(1)<<uint(t.Z)) * float64(extent)
+	minX := float64(t.X*extent-buffer) / scale
+	maxX := float64((t.X+1)*extent+buffer) / scale
+	minY := float64(t.Y*extent-buffer) / scale
+	maxY := float64((t.Y+1)*extent+buffer) / scale
+
+	// Y goes down, latitude goes up
+	minLon, maxLat := unproject(minX, minY)
+	maxLon, minLat := unproject(maxX, maxY)
+	return []float64{minLon, minLat, maxLon, maxLat}
+}
+
+// Tiles at the given zoom level that cover a bounding box
+func TilesCovering(z int, bbox []float64) []Tile {
+	minX, minY, maxX, maxY := TileRange(z, bbox)
+
+	result := make([]Tile, 0)
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			result = append(result, Tile{Z: z, X: x, Y: y})
+		}
+	}
+	return result
+}
+
+// Columns and rows of the tiles at the given zoom level that cover a bounding
+// box. The minimum exceeds the maximum for an empty (inverted) bounding box.
+func TileRange(z int, bbox []float64) (minX, minY, maxX, maxY int) {
+	n := 1 << uint(z)
+	left, top := project(bbox[0], bbox[3])
+	right, bottom := project(bbox[2], bbox[1])
+
+	// Compared as floats, huge values don't fit an int
+	clamp := func(v float64) int {
+		f := math.Floor(v * float64(n))
+		if f < 0 {
+			return 0
+		}
+		if f >= float64(n) {
+			return n - 1
+		}
+		return int(f)
+	}
+
+	return clamp(left), clamp(top), clamp(right), clamp(bottom)
+}
+
+// Spherical Mercator, normalized to [0, 1]
+func project(lon, lat float64) (float64, float64) {
+	lat = math.Max(math.Min(lat, MaxLatitude), -MaxLatitude)
+	sin := math.Sin(lat * math.Pi / 180)
+	x := lon/360 + 0.5
+	y := 0.5 - 0.25*math.Log((1+sin)/(1-sin))/math.Pi
+	return x, y
+}
+
+func unproject(x, y float64) (float64, float64) {
+	lon := (x - 0.5) * 360
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi
+	return lon, lat
+}
@@ -1,117 +1,277 @@
 package needidx
 
-type needTopLevel [256]*needLevel7
-type needLevel7 [256]*needLevel6
-type needLevel6 [256]*needLevel5
-type needLevel5 [256]*needLevel4
-type needLevel4 [256]*needLevel3
-type needLevel3 [256]*needLevel2
-type needLevel2 [256]*needLeaf
-type needLeaf [256]bool
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
 
+// IDs are stored in a paged bitset: pages of pageSize bits, grouped in
+// directories. Only pages with at least one ID in them are allocated.
+const (
+	pageBits  = 12
+	pageSize  = 1 << pageBits
+	pageWords = pageSize / 64
+
+	dirBits = 16
+	dirSize = 1 << dirBits
+
+	// Number of IDs covered by a directory
+	chunkBits = pageBits + dirBits
+
+	// Directories for IDs below 2^34 (all current OSM IDs) can be found
+	// without locking
+	fastDirs = 64
+)
+
+type page [pageWords]uint64
+
+// Pointers to pages
+type dir [dirSize]unsafe.Pointer
+
+// Set of (OSM) IDs. Safe for concurrent use.
 type NeedIdx struct {
-	entries needTopLevel
+	fast [fastDirs]unsafe.Pointer
+
+	// Directories of all other IDs
+	lock sync.RWMutex
+	dirs map[uint64]*dir
 }
 
 func New() *NeedIdx {
-	return &NeedIdx{}
+	return &NeedIdx{
+		dirs: make(map[uint64]*dir),
+	}
 }
 
-func (n *NeedIdx) MarkNeeded(id int64) {
-	k := byte(id >> 56)
-	v8 := n.entries[k]
-	if v8 == nil {
-		v8 = &needLevel7{}
-		n.entries[k] = v8
+// Loads a pointer, optionally filling it with a new value when nil
+func loadOrCreate(ptr *unsafe.Pointer, create func() unsafe.Pointer) unsafe.Pointer {
+	p := atomic.LoadPointer(ptr)
+	if p != nil || create == nil {
+		return p
 	}
 
-	k = byte(id >> 48)
-	v7 := v8[k]
-	if v7 == nil {
-		v7 = &needLevel6{}
-		v8[k] = v7
+	p = create()
+	if atomic.CompareAndSwapPointer(ptr, nil, p) {
+		return p
 	}
+	return atomic.LoadPointer(ptr)
+}
+
+func newDir() unsafe.Pointer  { return unsafe.Pointer(&dir{}) }
+func newPage() unsafe.Pointer { return unsafe.Pointer(&page{}) }
 
-	k = byte(id >> 40)
-	v6 := v7[k]
-	if v6 == nil {
-		v6 = &needLevel5{}
-		v7[k] = v6
+func (n *NeedIdx) getDir(key uint64, create bool) *dir {
+	if key < fastDirs {
+		var fn func() unsafe.Pointer
+		if create {
+			fn = newDir
+		}
+		return (*dir)(loadOrCreate(&n.fast[key], fn))
 	}
 
-	k = byte(id >> 32)
-	v5 := v6[k]
-	if v5 == nil {
-		v5 = &needLevel4{}
-		v6[k] = v5
+	n.lock.RLock()
+	d := n.dirs[key]
+	n.lock.RUnlock()
+	if d != nil || !create {
+		return d
 	}
 
-	k = byte(id >> 24)
-	v4 := v5[k]
-	if v4 == nil {
-		v4 = &needLevel3{}
-		v5[k] = v4
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	d = n.dirs[key]
+	if d == nil {
+		d = &dir{}
+		n.dirs[key] = d
 	}
+	return d
+}
 
-	k = byte(id >> 16)
-	v3 := v4[k]
-	if v3 == nil {
-		v3 = &needLevel2{}
-		v4[k] = v3
+func (n *NeedIdx) getPage(id uint64, create bool) *page {
+	d := n.getDir(id>>chunkBits, create)
+	if d == nil {
+		return nil
 	}
 
-	k = byte(id >> 8)
-	v2 := v3[k]
-	if v2 == nil {
-		v2 = &needLeaf{}
-		v3[k] = v2
+	var fn func() unsafe.Pointer
+	if create {
+		fn = newPage
 	}
+	return (*page)(loadOrCreate(&d[(id>>pageBits)&(dirSize-1)], fn))
+}
 
-	v2[byte(id)] = true
+func (n *NeedIdx) MarkNeeded(id int64) {
+	u := uint64(id)
+	p := n.getPage(u, true)
+	word := &p[(u&(pageSize-1))>>6]
+	mask := uint64(1) << (u & 63)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+			return
+		}
+	}
 }
 
 func (n *NeedIdx) IsNeeded(id int64) bool {
-	k := byte(id >> 56)
-	v8 := n.entries[k]
-	if v8 == nil {
+	u := uint64(id)
+	p := n.getPage(u, false)
+	if p == nil {
 		return false
 	}
+	return atomic.LoadUint64(&p[(u&(pageSize-1))>>6])&(1<<(u&63)) != 0
+}
 
-	k = byte(id >> 48)
-	v7 := v8[k]
-	if v7 == nil {
-		return false
+// Calls fn for every allocated page, in order
+func (n *NeedIdx) eachPage(fn func(base uint64, p *page) error) error {
+	keys := make(dirKeys, 0, fastDirs)
+	for key := uint64(0); key < fastDirs; key++ {
+		if atomic.LoadPointer(&n.fast[key]) != nil {
+			keys = append(keys, key)
+		}
+	}
+	n.lock.RLock()
+	for key := range n.dirs {
+		keys = append(keys, key)
 	}
+	n.lock.RUnlock()
+	sort.Sort(keys)
 
-	k = byte(id >> 40)
-	v6 := v7[k]
-	if v6 == nil {
-		return false
+	for _, key := range keys {
+		d := n.getDir(key, false)
+		for i := range d {
+			p := (*page)(atomic.LoadPointer(&d[i]))
+			if p == nil {
+				continue
+			}
+
+			err := fn(key<<chunkBits|uint64(i)<<pageBits, p)
+			if err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	k = byte(id >> 32)
-	v5 := v6[k]
-	if v5 == nil {
-		return false
+// Number of needed IDs
+func (n *NeedIdx) Count() int64 {
+	count := int64(0)
+	n.eachPage(func(base uint64, p *page) error {
+		for w := range p {
+			count += int64(bits.OnesCount64(atomic.LoadUint64(&p[w])))
+		}
+		return nil
+	})
+	return count
+}
+
+// Calls fn for every needed ID, in (unsigned) ascending order. Stops at the
+// first error. IDs marked while iterating may or may not be included.
+func (n *NeedIdx) Iterate(fn func(id int64) error) error {
+	return n.eachPage(func(base uint64, p *page) error {
+		for w := range p {
+			word := atomic.LoadUint64(&p[w])
+			for word != 0 {
+				b := uint64(bits.TrailingZeros64(word))
+				word &^= 1 << b
+
+				err := fn(int64(base | uint64(w)<<6 | b))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+type dirKeys []uint64
+
+func (d dirKeys) Len() int           { return len(d) }
+func (d dirKeys) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d dirKeys) Less(i, j int) bool { return d[i] < d[j] }
+
+// Serializes the index: a header followed by the needed IDs, delta encoded as
+// varints.
+func (n *NeedIdx) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	written := int64(0)
+
+	c, err := bw.WriteString(header)
+	written += int64(c)
+	if err != nil {
+		return written, err
 	}
 
-	k = byte(id >> 24)
-	v4 := v5[k]
-	if v4 == nil {
-		return false
+	buf := make([]byte, binary.MaxVarintLen64)
+	prev := uint64(0)
+	err = n.Iterate(func(id int64) error {
+		l := binary.PutUvarint(buf, uint64(id)-prev)
+		prev = uint64(id)
+
+		c, err := bw.Write(buf[:l])
+		written += int64(c)
+		return err
+	})
+	if err != nil {
+		return written, err
 	}
 
-	k = byte(id >> 16)
-	v3 := v4[k]
-	if v3 == nil {
-		return false
+	return written, bw.Flush()
+}
+
+// Reads an index written with WriteTo, adding its IDs to this one
+func (n *NeedIdx) ReadFrom(r io.Reader) (int64, error) {
+	br := &countingReader{r: bufio.NewReader(r)}
+
+	h := make([]byte, len(header))
+	_, err := io.ReadFull(br, h)
+	if err != nil {
+		return br.n, err
+	}
+	if string(h) != header {
+		return br.n, errors.New("Not a need index")
 	}
 
-	k = byte(id >> 8)
-	v2 := v3[k]
-	if v2 == nil {
-		return false
+	prev := uint64(0)
+	for {
+		delta, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return br.n, nil
+		}
+		if err != nil {
+			return br.n, err
+		}
+
+		prev += delta
+		n.MarkNeeded(int64(prev))
 	}
+}
+
+const header = "needidx1"
 
-	return v2[byte(id)]
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
 }
@@ -1,6 +1,10 @@
 package needidx
 
 import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cheekybits/is"
@@ -43,3 +47,267 @@ func TestNeedIdx(t *testing.T) {
 		is.True(idx.IsNeeded(1 >> uint32(i)))
 	}
 }
+
+func TestNeedIdxRoundTrip(t *testing.T) {
+	is := is.New(t)
+
+	ids := []int64{0, 1, 255, 256, 10250, 1 << 40, -1}
+
+	idx := New()
+	for _, id := range ids {
+		idx.MarkNeeded(id)
+	}
+
+	found := make([]int64, 0)
+	err := idx.Iterate(func(id int64) error {
+		found = append(found, id)
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(found, ids)
+
+	var buf bytes.Buffer
+	n, err := idx.WriteTo(&buf)
+	is.NoErr(err)
+	is.Equal(n, int64(buf.Len()))
+
+	idx2 := New()
+	m, err := idx2.ReadFrom(&buf)
+	is.NoErr(err)
+	is.Equal(m, n)
+	for _, id := range ids {
+		is.True(idx2.IsNeeded(id))
+	}
+	is.False(idx2.IsNeeded(2))
+
+	_, err = New().ReadFrom(strings.NewReader("garbage!"))
+	is.Err(err)
+}
+
+// The original trie implementation, kept as a baseline for the benchmarks
+type needTopLevel [256]*needLevel7
+type needLevel7 [256]*needLevel6
+type needLevel6 [256]*needLevel5
+type needLevel5 [256]*needLevel4
+type needLevel4 [256]*needLevel3
+type needLevel3 [256]*needLevel2
+type needLevel2 [256]*needLeaf
+type needLeaf [256]bool
+
+type trieIdx struct {
+	entries needTopLevel
+}
+
+func (n *trieIdx) MarkNeeded(id int64) {
+	k := byte(id >> 56)
+	v8 := n.entries[k]
+	if v8 == nil {
+		v8 = &needLevel7{}
+		n.entries[k] = v8
+	}
+
+	k = byte(id >> 48)
+	v7 := v8[k]
+	if v7 == nil {
+		v7 = &needLevel6{}
+		v8[k] = v7
+	}
+
+	k = byte(id >> 40)
+	v6 := v7[k]
+	if v6 == nil {
+		v6 = &needLevel5{}
+		v7[k] = v6
+	}
+
+	k = byte(id >> 32)
+	v5 := v6[k]
+	if v5 == nil {
+		v5 = &needLevel4{}
+		v6[k] = v5
+	}
+
+	k = byte(id >> 24)
+	v4 := v5[k]
+	if v4 == nil {
+		v4 = &needLevel3{}
+		v5[k] = v4
+	}
+
+	k = byte(id >> 16)
+	v3 := v4[k]
+	if v3 == nil {
+		v3 = &needLevel2{}
+		v4[k] = v3
+	}
+
+	k = byte(id >> 8)
+	v2 := v3[k]
+	if v2 == nil {
+		v2 = &needLeaf{}
+		v3[k] = v2
+	}
+
+	v2[byte(id)] = true
+}
+
+func (n *trieIdx) IsNeeded(id int64) bool {
+	k := byte(id >> 56)
+	v8 := n.entries[k]
+	if v8 == nil {
+		return false
+	}
+
+	k = byte(id >> 48)
+	v7 := v8[k]
+	if v7 == nil {
+		return false
+	}
+
+	k = byte(id >> 40)
+	v6 := v7[k]
+	if v6 == nil {
+		return false
+	}
+
+	k = byte(id >> 32)
+	v5 := v6[k]
+	if v5 == nil {
+		return false
+	}
+
+	k = byte(id >> 24)
+	v4 := v5[k]
+	if v4 == nil {
+		return false
+	}
+
+	k = byte(id >> 16)
+	v3 := v4[k]
+	if v3 == nil {
+		return false
+	}
+
+	k = byte(id >> 8)
+	v2 := v3[k]
+	if v2 == nil {
+		return false
+	}
+
+	return v2[byte(id)]
+}
+
+func TestNeedIdxCount(t *testing.T) {
+	is := is.New(t)
+
+	idx := New()
+	is.Equal(idx.Count(), int64(0))
+
+	// Spread over multiple pages and shards
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100000; i++ {
+				idx.MarkNeeded(int64(i*3 + w%2))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	is.Equal(idx.Count(), int64(200000))
+	is.True(idx.IsNeeded(299998))
+	is.True(idx.IsNeeded(299997))
+	is.False(idx.IsNeeded(299999))
+
+	prev := int64(-1)
+	count := 0
+	err := idx.Iterate(func(id int64) error {
+		is.True(id > prev)
+		prev = id
+		count++
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(count, 200000)
+}
+
+// Roughly the density of nodes needed for boundaries
+func benchmarkIDs() []int64 {
+	r := rand.New(rand.NewSource(42))
+	ids := make([]int64, 1000000)
+	for i := range ids {
+		ids[i] = r.Int63n(6000000000)
+	}
+	return ids
+}
+
+func BenchmarkMarkNeeded(b *testing.B) {
+	ids := benchmarkIDs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		idx := New()
+		for _, id := range ids {
+			idx.MarkNeeded(id)
+		}
+	}
+}
+
+func BenchmarkMarkNeededTrie(b *testing.B) {
+	ids := benchmarkIDs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		idx := &trieIdx{}
+		for _, id := range ids {
+			idx.MarkNeeded(id)
+		}
+	}
+}
+
+func BenchmarkIsNeeded(b *testing.B) {
+	ids := benchmarkIDs()
+	idx := New()
+	for _, id := range ids[:len(ids)/2] {
+		idx.MarkNeeded(id)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, id := range ids {
+			idx.IsNeeded(id)
+		}
+	}
+}
+
+func BenchmarkIsNeededTrie(b *testing.B) {
+	ids := benchmarkIDs()
+	idx := &trieIdx{}
+	for _, id := range ids[:len(ids)/2] {
+		idx.MarkNeeded(id)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, id := range ids {
+			idx.IsNeeded(id)
+		}
+	}
+}
+
+// Dense range of IDs, as found when most ways of an area are needed
+func BenchmarkMarkNeededDense(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		idx := New()
+		for id := int64(0); id < 1000000; id++ {
+			idx.MarkNeeded(id)
+		}
+	}
+}
+
+func BenchmarkMarkNeededDenseTrie(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		idx := &trieIdx{}
+		for id := int64(0); id < 1000000; id++ {
+			idx.MarkNeeded(id)
+		}
+	}
+}
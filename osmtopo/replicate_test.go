@@ -1,9 +1,18 @@
 package osmtopo
 
 import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/cheekybits/is"
+	"github.com/omniscale/imposm3/element"
+	"github.com/rubenv/osmtopo/osmtopo/model"
 )
 
 func TestFetchLatestSequence(t *testing.T) {
@@ -23,3 +32,255 @@ func TestChangesetUrl(t *testing.T) {
 	is.Equal(changesetUrl(url, 1), url+"/000/000/001.osc.gz")
 	is.Equal(changesetUrl(url, 123456789), url+"/123/456/789.osc.gz")
 }
+
+// Serves the given osmChange document as every changeset
+func serveChange(change string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(change))
+		gz.Close()
+	}))
+}
+
+func TestApplyDeltaVersions(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	env, err := prepareEnv(NewConfig(), path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	// The way and relation get changed twice in the same changeset.
+	// Relation 101 is no longer accepted in its last version, relation 102
+	// gets deleted again.
+	server := serveChange(`<?xml version="1.0" encoding="UTF-8"?>
+<osmChange version="0.6" generator="test">
+<create>
+  <node id="1" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.1" lon="-4.5"/>
+  <node id="2" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.2" lon="-4.5"/>
+  <node id="3" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.2" lon="-4.4"/>
+  <way id="10" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <nd ref="1"/>
+    <nd ref="2"/>
+  </way>
+  <relation id="100" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="10" role="outer"/>
+    <member type="way" ref="11" role="outer"/>
+    <tag k="admin_level" v="8"/>
+  </relation>
+  <relation id="101" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="10" role="outer"/>
+    <tag k="admin_level" v="9"/>
+  </relation>
+  <relation id="102" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="10" role="outer"/>
+    <tag k="admin_level" v="10"/>
+  </relation>
+</create>
+<modify>
+  <way id="10" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <nd ref="2"/>
+    <nd ref="3"/>
+  </way>
+  <relation id="100" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="10" role="outer"/>
+    <tag k="admin_level" v="8"/>
+  </relation>
+  <relation id="101" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="10" role="outer"/>
+    <tag k="type" v="route"/>
+  </relation>
+</modify>
+<delete>
+  <relation id="102" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="10" role="outer"/>
+    <tag k="admin_level" v="10"/>
+  </relation>
+</delete>
+</osmChange>
+`)
+	defer server.Close()
+
+	err = env.applyDelta("test", PBFSource{Update: server.URL}, nil, folder, 0)
+	is.NoErr(err)
+
+	way, err := env.GetWay(10)
+	is.NoErr(err)
+	is.Equal(way.Refs, []int64{2, 3})
+
+	// Only the index entries of the last version are left
+	ways, err := env.getNodeWays(1)
+	is.NoErr(err)
+	is.Equal(len(ways), 0)
+	ways, err = env.getNodeWays(3)
+	is.NoErr(err)
+	is.Equal(ways, []int64{10})
+
+	rels, err := env.getWayRelations(11)
+	is.NoErr(err)
+	is.Equal(len(rels), 0)
+	rels, err = env.getWayRelations(10)
+	is.NoErr(err)
+	is.Equal(rels, []int64{100})
+
+	for _, id := range []int64{101, 102} {
+		rel, err := env.GetRelation(id)
+		is.NoErr(err)
+		is.Nil(rel)
+	}
+}
+
+func TestApplyDeltaClip(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	// Relation 300 gets created outside of the clip area, relation 200
+	// moves out of it. Only the nodes of relation 202 move out.
+	server := serveChange(`<?xml version="1.0" encoding="UTF-8"?>
+<osmChange version="0.6" generator="test">
+<create>
+  <node id="7" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.3" lon="-4.4"/>
+  <node id="8" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.4" lon="-4.4"/>
+  <node id="9" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.4" lon="-4.3"/>
+  <way id="30" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <nd ref="7"/>
+    <nd ref="8"/>
+    <nd ref="9"/>
+    <nd ref="7"/>
+  </way>
+  <relation id="300" version="1" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="30" role="outer"/>
+    <tag k="admin_level" v="8"/>
+  </relation>
+</create>
+<modify>
+  <node id="1" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.3" lon="-4.3"/>
+  <node id="2" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.4" lon="-4.3"/>
+  <node id="3" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.4" lon="-4.2"/>
+  <relation id="200" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1">
+    <member type="way" ref="20" role="outer"/>
+    <tag k="admin_level" v="8"/>
+    <tag k="name" v="Moved"/>
+  </relation>
+  <node id="10" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.5" lon="-4.3"/>
+  <node id="11" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.6" lon="-4.3"/>
+  <node id="12" version="2" timestamp="2019-05-01T00:00:00Z" uid="1" user="test" changeset="1" lat="54.6" lon="-4.2"/>
+</modify>
+</osmChange>
+`)
+	defer server.Close()
+
+	source := PBFSource{
+		Update: server.URL,
+		Clip:   []float64{-4.9, 54.0, -4.6, 54.12},
+	}
+	config := NewConfig()
+	config.Sources = map[string]PBFSource{"test": source}
+
+	env, err := prepareEnv(config, path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	// Three relations inside of the clip area
+	is.NoErr(env.addNewNodes([]model.Node{
+		{Id: 1, Lat: 54.05, Lon: -4.8},
+		{Id: 2, Lat: 54.1, Lon: -4.8},
+		{Id: 3, Lat: 54.1, Lon: -4.7},
+		{Id: 4, Lat: 54.02, Lon: -4.8},
+		{Id: 5, Lat: 54.03, Lon: -4.8},
+		{Id: 6, Lat: 54.03, Lon: -4.7},
+		{Id: 10, Lat: 54.06, Lon: -4.65},
+		{Id: 11, Lat: 54.08, Lon: -4.65},
+		{Id: 12, Lat: 54.08, Lon: -4.62},
+	}))
+	is.NoErr(env.addNewWays([]model.Way{
+		{Id: 20, Refs: []int64{1, 2, 3, 1}},
+		{Id: 21, Refs: []int64{4, 5, 6, 4}},
+		{Id: 22, Refs: []int64{10, 11, 12, 10}},
+	}))
+	tags := []*model.TagEntry{{Key: "admin_level", Value: "8"}}
+	is.NoErr(env.addNewRelations([]model.Relation{
+		{Id: 200, Tags: tags, Members: []*model.MemberEntry{{Id: 20, Type: int32(element.WAY), Role: "outer"}}},
+		{Id: 201, Tags: tags, Members: []*model.MemberEntry{{Id: 21, Type: int32(element.WAY), Role: "outer"}}},
+		{Id: 202, Tags: tags, Members: []*model.MemberEntry{{Id: 22, Type: int32(element.WAY), Role: "outer"}}},
+	}))
+
+	clip, err := loadClipArea(source)
+	is.NoErr(err)
+	err = env.applyDelta("test", source, clip, folder, 0)
+	is.NoErr(err)
+
+	for id, kept := range map[int64]bool{200: false, 201: true, 202: false, 300: false} {
+		rel, err := env.GetRelation(id)
+		is.NoErr(err)
+		is.Equal(rel != nil, kept)
+	}
+
+	// The ways and nodes of the removed relations are cleaned up
+	for id, kept := range map[int64]bool{20: false, 21: true, 22: false, 30: false} {
+		way, err := env.GetWay(id)
+		is.NoErr(err)
+		is.Equal(way != nil, kept)
+	}
+	for id, kept := range map[int64]bool{1: false, 4: true, 7: false, 10: false} {
+		node, err := env.GetNode(id)
+		is.NoErr(err)
+		is.Equal(node != nil, kept)
+	}
+
+	// Only the relations that were stored before show up as changed
+	changes, err := env.GetChanges("test", 0)
+	is.NoErr(err)
+	is.Equal(len(changes), 1)
+	is.Equal(changes[0].Relations, []int64{200, 202})
+}
+
+func TestChangeRetention(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	config := NewConfig()
+	config.Sources = map[string]PBFSource{"test": PBFSource{}}
+	config.KeepChanges = int64(Day.Seconds())
+
+	env, err := prepareEnv(config, path.Join(folder, "topo.yaml"), path.Join(folder, "store"), path.Join(folder, "output"), false)
+	is.NoErr(err)
+	defer env.Stop()
+
+	now := time.Date(2019, 5, 10, 0, 0, 0, 0, time.UTC)
+	for seq, age := range []time.Duration{3 * Day, 2 * Day, 12 * time.Hour, 0} {
+		is.NoErr(env.addChange(&ChangeEntry{
+			Source:    "test",
+			Sequence:  int64(seq + 1),
+			Time:      now.Add(-age),
+			Relations: []int64{int64(seq)},
+		}))
+	}
+
+	// Only the changes of the last day are kept
+	changes, err := env.GetChanges("test", 0)
+	is.NoErr(err)
+	is.Equal(len(changes), 2)
+	is.Equal(changes[0].Sequence, int64(3))
+	is.Equal(changes[1].Sequence, int64(4))
+
+	// Unless the journal is kept forever
+	config.KeepChanges = 0
+	is.NoErr(env.addChange(&ChangeEntry{
+		Source:   "test",
+		Sequence: 5,
+		Time:     now.Add(10 * Day),
+	}))
+	changes, err = env.GetChanges("test", 0)
+	is.NoErr(err)
+	is.Equal(len(changes), 3)
+}
@@ -0,0 +1,222 @@
+package osmtopo
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	shp "github.com/jonas-p/go-shp"
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// WGS 84, in the ESRI flavor of WKT
+const shapefilePrj = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+
+// Files that make up a shapefile, next to the .shp file
+var shapefileSidecars = []string{".shx", ".dbf", ".prj", ".cpg"}
+
+// DBF limits
+const (
+	maxFieldName   = 10
+	maxFieldLength = 254
+)
+
+type shapefileColumn struct {
+	Property string
+	Field    string
+	Size     int
+}
+
+// Writes the features as a polygon shapefile. Properties become text
+// attributes, with names shortened to fit in DBF field names (name:en becomes
+// name_en).
+func writeShapefile(filename string, fc *geojson.FeatureCollection) error {
+	columns := shapefileColumns(fc)
+
+	w, err := shp.Create(filename, shp.POLYGON)
+	if err != nil {
+		return err
+	}
+
+	fields := make([]shp.Field, len(columns))
+	for i, c := range columns {
+		fields[i] = shp.StringField(c.Field, uint8(c.Size))
+	}
+	err = w.SetFields(fields)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	for _, f := range fc.Features {
+		parts := shapefileParts(f.Geometry)
+		if len(parts) == 0 {
+			continue
+		}
+
+		poly := shp.Polygon(*shp.NewPolyLine(parts))
+		row := int(w.Write(&poly))
+		for i, c := range columns {
+			v, ok := f.Properties[c.Property].(string)
+			if !ok {
+				continue
+			}
+
+			err = w.WriteAttribute(row, i, truncateString(v, c.Size))
+			if err != nil {
+				w.Close()
+				return err
+			}
+		}
+	}
+	w.Close()
+
+	base := strings.TrimSuffix(filename, ".shp")
+	err = ioutil.WriteFile(base+".prj", []byte(shapefilePrj), 0644)
+	if err != nil {
+		return err
+	}
+
+	// Attributes are written as UTF-8
+	return ioutil.WriteFile(base+".cpg", []byte("UTF-8"), 0644)
+}
+
+// Collects the string properties of the features, along with the DBF field
+// they're stored in
+func shapefileColumns(fc *geojson.FeatureCollection) []shapefileColumn {
+	sizes := make(map[string]int)
+	for _, f := range fc.Features {
+		for k, v := range f.Properties {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			if len(s) > sizes[k] {
+				sizes[k] = len(s)
+			}
+			if sizes[k] == 0 {
+				sizes[k] = 1
+			}
+		}
+	}
+
+	properties := make([]string, 0, len(sizes))
+	for k := range sizes {
+		properties = append(properties, k)
+	}
+	sort.Strings(properties)
+
+	used := make(map[string]bool)
+	result := make([]shapefileColumn, 0, len(properties))
+	for _, property := range properties {
+		field := fieldName(property, used)
+		used[field] = true
+
+		size := sizes[property]
+		if size > maxFieldLength {
+			size = maxFieldLength
+		}
+
+		result = append(result, shapefileColumn{
+			Property: property,
+			Field:    field,
+			Size:     size,
+		})
+	}
+	return result
+}
+
+// Turns a property name into a unique DBF field name: at most 10 characters,
+// only letters, digits and underscores.
+func fieldName(property string, used map[string]bool) string {
+	name := []byte(property)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+
+	base := string(name)
+	if len(base) > maxFieldName {
+		base = base[:maxFieldName]
+	}
+	if !used[base] {
+		return base
+	}
+
+	for i := 1; ; i++ {
+		suffix := strconv.Itoa(i)
+		prefix := base
+		if len(prefix)+len(suffix) > maxFieldName {
+			prefix = prefix[:maxFieldName-len(suffix)]
+		}
+		if !used[prefix+suffix] {
+			return prefix + suffix
+		}
+	}
+}
+
+// Shortens a string to at most n bytes, without cutting characters in half
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// Rings of a (multi)polygon, oriented as shapefiles require: outer rings
+// clockwise, holes counter-clockwise
+func shapefileParts(g *geojson.Geometry) [][]shp.Point {
+	if g == nil {
+		return nil
+	}
+
+	var polygons [][][][]float64
+	switch g.Type {
+	case geojson.GeometryPolygon:
+		polygons = [][][][]float64{g.Polygon}
+	case geojson.GeometryMultiPolygon:
+		polygons = g.MultiPolygon
+	default:
+		return nil
+	}
+
+	result := make([][]shp.Point, 0)
+	for _, poly := range polygons {
+		for i, ring := range poly {
+			points := make([]shp.Point, len(ring))
+			for j, p := range ring {
+				points[j] = shp.Point{X: p[0], Y: p[1]}
+			}
+
+			// ringArea is positive for clockwise rings
+			area := ringArea(points)
+			if (i == 0 && area < 0) || (i > 0 && area > 0) {
+				for a, b := 0, len(points)-1; a < b; a, b = a+1, b-1 {
+					points[a], points[b] = points[b], points[a]
+				}
+			}
+			result = append(result, points)
+		}
+	}
+	return result
+}
+
+// Removes a shapefile, along with its sidecar files
+func removeShapefile(filename string) error {
+	base := strings.TrimSuffix(filename, ".shp")
+	for _, ext := range append([]string{".shp"}, shapefileSidecars...) {
+		err := os.Remove(base + ext)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
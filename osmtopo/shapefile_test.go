@@ -0,0 +1,75 @@
+package osmtopo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cheekybits/is"
+	shp "github.com/jonas-p/go-shp"
+	geojson "github.com/paulmach/go.geojson"
+)
+
+func TestWriteShapefile(t *testing.T) {
+	is := is.New(t)
+
+	folder, err := ioutil.TempDir("", "test")
+	is.NoErr(err)
+	defer os.RemoveAll(folder)
+
+	// Counter-clockwise outer rings, clockwise hole: all need to be flipped
+	outer := [][]float64{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}}
+	hole := [][]float64{{1, 1}, {1, 2}, {2, 2}, {2, 1}, {1, 1}}
+	other := [][]float64{{5, 0}, {6, 0}, {6, 1}, {5, 1}, {5, 0}}
+
+	fc := geojson.NewFeatureCollection()
+	f := geojson.NewMultiPolygonFeature([][][]float64{outer, hole}, [][][]float64{other})
+	f.SetProperty("id", "1234")
+	f.SetProperty("name", "Brussel")
+	f.SetProperty("name:fr", "Bruxelles")
+	f.SetProperty("name:zh-Hans", "布鲁塞尔")
+	f.SetProperty("name:zh-Hant", "布魯塞爾")
+	fc.AddFeature(f)
+
+	filename := path.Join(folder, "cities.shp")
+	err = writeShapefile(filename, fc)
+	is.NoErr(err)
+
+	isFile(is, path.Join(folder, "cities.prj"))
+	isFile(is, path.Join(folder, "cities.cpg"))
+
+	r, err := shp.Open(filename)
+	is.NoErr(err)
+	defer r.Close()
+
+	fields := r.Fields()
+	is.Equal(len(fields), 5)
+	is.Equal(fields[0].String(), "id")
+	is.Equal(fields[1].String(), "name")
+	is.Equal(fields[2].String(), "name_fr")
+	is.Equal(fields[3].String(), "name_zh_Ha")
+	is.Equal(fields[4].String(), "name_zh_H1")
+
+	is.True(r.Next())
+	n, shape := r.Shape()
+	is.Equal(n, 0)
+	is.Equal(r.ReadAttribute(n, 0), "1234")
+	is.Equal(r.ReadAttribute(n, 2), "Bruxelles")
+	is.Equal(r.ReadAttribute(n, 4), "布魯塞爾")
+
+	poly := shape.(*shp.Polygon)
+	is.Equal(poly.NumParts, int32(3))
+	is.Equal(poly.Parts, []int32{0, 5, 10})
+
+	is.True(ringArea(poly.Points[0:5]) > 0)
+	is.True(ringArea(poly.Points[5:10]) < 0)
+	is.True(ringArea(poly.Points[10:15]) > 0)
+
+	is.False(r.Next())
+
+	is.NoErr(removeShapefile(filename))
+	files, err := ioutil.ReadDir(folder)
+	is.NoErr(err)
+	is.Equal(len(files), 0)
+}
@@ -8,10 +8,12 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/northbright/ctx/ctxdownload"
 	"github.com/omniscale/imposm3/parser/diff"
 	"github.com/rubenv/osmtopo/osmtopo/model"
+	"github.com/tecbot/gorocksdb"
 )
 
 func (e *Env) updateSource(name string, source PBFSource) error {
@@ -41,11 +43,6 @@ func (e *Env) updateSource(name string, source PBFSource) error {
 		if err != nil {
 			return err
 		}
-
-		err = e.setFlag(flag, true)
-		if err != nil {
-			return err
-		}
 	} else {
 		err = e.updateDeltas(name, source, tmp)
 		if err != nil {
@@ -73,14 +70,78 @@ func (e *Env) importPBF(name string, source PBFSource, folder string) error {
 		fullname = source.Seed
 	}
 
-	i := newImporter(e, name, fullname)
-	seq, err := i.Run()
+	err := e.ImportFile(name, fullname)
 	if err != nil {
 		return err
 	}
 
 	e.log(fmt.Sprintf("source/%s", name), "Done")
-	return e.setInt(fmt.Sprintf("seq/%s", name), seq)
+	return nil
+}
+
+// Imports a local PBF file as the given source. Records the replication
+// sequence of the file, so future updates continue from there.
+func (e *Env) ImportFile(name, filename string) error {
+	return e.ImportFileMode(name, filename, e.config.Sources[name].ImportMode)
+}
+
+// Imports a local PBF file like ImportFile, with the given import mode
+// (ImportMultiPass or ImportSinglePass)
+func (e *Env) ImportFileMode(name, filename, mode string) error {
+	e.done.Add(1)
+	defer e.done.Done()
+
+	clip, err := loadClipArea(e.config.Sources[name])
+	if err != nil {
+		return fmt.Errorf("Source %s: %s", name, err)
+	}
+
+	i := newImporter(e, name, filename, clip, mode)
+	seq, err := i.Run()
+	if err != nil {
+		return err
+	}
+
+	err = e.setInt(fmt.Sprintf("seq/%s", name), seq)
+	if err != nil {
+		return err
+	}
+
+	err = e.markReverseIndexed(name)
+	if err != nil {
+		return err
+	}
+
+	return e.setFlag(fmt.Sprintf("imported/%s", name), true)
+}
+
+// The importer writes the reverse indexes, so they are complete after
+// importing into a store that holds no other sources. Saves rebuilding them
+// on the first replication.
+func (e *Env) markReverseIndexed(name string) error {
+	indexed, err := e.getFlag("reverse-index")
+	if err != nil {
+		return err
+	}
+	if indexed {
+		return nil
+	}
+
+	for other := range e.config.Sources {
+		if other == name {
+			continue
+		}
+		imported, err := e.getFlag(fmt.Sprintf("imported/%s", other))
+		if err != nil {
+			return err
+		}
+		if imported {
+			// Might predate the reverse indexes
+			return nil
+		}
+	}
+
+	return e.setFlag("reverse-index", true)
 }
 
 func (e *Env) downloadPBF(name, folder, filename, url string) error {
@@ -108,19 +169,46 @@ func (e *Env) updateDeltas(name string, source PBFSource, folder string) error {
 		return nil
 	}
 
+	err = e.ensureReverseIndex()
+	if err != nil {
+		return err
+	}
+
+	clip, err := loadClipArea(source)
+	if err != nil {
+		return fmt.Errorf("Source %s: %s", name, err)
+	}
+
 	e.log(fmt.Sprintf("source/%s", name), "Replicating from %d -> %d", seq, current)
+	progress := Progress{
+		Source:       name,
+		Task:         "replicate",
+		Phase:        "changes",
+		Started:      time.Now(),
+		FromSequence: seq,
+		Sequence:     seq,
+		ToSequence:   current,
+	}
+	e.setProgress(&progress)
+	defer e.setProgress(nil)
+
 	for seq < current {
-		err = e.applyDelta(name, source, folder, seq)
+		err = e.applyDelta(name, source, clip, folder, seq)
 		if err != nil {
 			return err
 		}
 		seq++
+
+		p := progress
+		p.Sequence = seq
+		p.ETA = estimateCompletion(p.Started, seq-p.FromSequence, current-p.FromSequence)
+		e.setProgress(&p)
 	}
 
 	return e.setInt(key, seq)
 }
 
-func (e *Env) applyDelta(name string, source PBFSource, folder string, seq int64) error {
+func (e *Env) applyDelta(name string, source PBFSource, clip *clipArea, folder string, seq int64) error {
 	e.log(fmt.Sprintf("source/%s", name), "Replicating change %d", seq+1)
 	filename, err := fetchChangeset(e.ctx, source.Update, seq, folder)
 	if err != nil {
@@ -143,6 +231,17 @@ func (e *Env) applyDelta(name string, source PBFSource, folder string, seq int64
 	newNodes := make([]model.Node, 0)
 	newWays := make([]model.Way, 0)
 	newRelations := make([]model.Relation, 0)
+
+	// Everything that changed, used to find the relations that need their
+	// derived data invalidated
+	changedNodes := make([]int64, 0)
+	changedWays := make([]int64, 0)
+	changedRelations := make([]int64, 0)
+
+	// Relations that were stored before this change, only tracked when
+	// clipping: relations created outside of the clip area get pruned
+	// right away and shouldn't show up as changed
+	stored := make(map[int64]bool)
 	for e.ctx.Err() == nil {
 		elem, err := parser.Next()
 		if err == io.EOF {
@@ -152,6 +251,13 @@ func (e *Env) applyDelta(name string, source PBFSource, folder string, seq int64
 			return err
 		}
 
+		if elem.Node != nil {
+			changedNodes = append(changedNodes, elem.Node.Id)
+		}
+		if elem.Way != nil {
+			changedWays = append(changedWays, elem.Way.Id)
+		}
+
 		switch {
 		case elem.Del:
 			if elem.Node != nil {
@@ -169,7 +275,19 @@ func (e *Env) applyDelta(name string, source PBFSource, folder string, seq int64
 				}
 			}
 			if elem.Rel != nil {
-				r := RelationFromEl(*elem.Rel)
+				// An earlier version in this change may be queued
+				newRelations = withoutRelation(newRelations, elem.Rel.Id)
+
+				// Only track relations that were actually stored
+				old, err := e.GetRelation(elem.Rel.Id)
+				if err != nil {
+					return err
+				}
+				if old != nil {
+					changedRelations = append(changedRelations, old.Id)
+				}
+
+				r := RelationFromEl(*elem.Rel, e.config.AcceptTag)
 				err = e.removeRelation(r)
 				if err != nil {
 					return err
@@ -187,9 +305,35 @@ func (e *Env) applyDelta(name string, source PBFSource, folder string, seq int64
 				newWays = append(newWays, w)
 			}
 			if elem.Rel != nil {
-				r := RelationFromEl(*elem.Rel)
-				if AcceptRelation(r, e.config.Blacklist) {
+				r := RelationFromEl(*elem.Rel, e.config.AcceptTag)
+				if e.config.AcceptRelation(elem.Rel.Id, elem.Rel.Tags) {
+					if clip != nil {
+						old, err := e.GetRelation(r.Id)
+						if err != nil {
+							return err
+						}
+						if old != nil {
+							stored[r.Id] = true
+						}
+					}
 					newRelations = append(newRelations, r)
+					changedRelations = append(changedRelations, r.Id)
+					continue
+				}
+
+				// No longer accepted (tags changed or blacklisted):
+				// treat it as deleted
+				newRelations = withoutRelation(newRelations, r.Id)
+				old, err := e.GetRelation(r.Id)
+				if err != nil {
+					return err
+				}
+				if old != nil {
+					changedRelations = append(changedRelations, old.Id)
+					err = e.removeRelation(r)
+					if err != nil {
+						return err
+					}
 				}
 			}
 		}
@@ -204,17 +348,208 @@ func (e *Env) applyDelta(name string, source PBFSource, folder string, seq int64
 		}
 	}
 	if len(newWays) > 0 {
-		err = e.addNewWays(newWays)
+		err = e.replaceWays(newWays)
 		if err != nil {
 			return err
 		}
 	}
 	if len(newRelations) > 0 {
-		err = e.addNewRelations(newRelations)
+		err = e.replaceRelations(newRelations)
+		if err != nil {
+			return err
+		}
+	}
+	if e.ctx.Err() != nil {
+		return e.ctx.Err()
+	}
+
+	affected, err := e.invalidateRelations(changedNodes, changedWays, changedRelations)
+	if err != nil {
+		return err
+	}
+
+	// Relations also end up outside of the clip area when only their ways
+	// or nodes move, check all of the affected ones
+	if clip != nil && len(affected) > 0 {
+		pruned, err := e.pruneRelations(clip, affected)
+		if err != nil {
+			return err
+		}
+
+		created := make(map[int64]bool)
+		for _, r := range newRelations {
+			if !stored[r.Id] {
+				created[r.Id] = true
+			}
+		}
+		dropped := make(map[int64]bool)
+		for _, id := range pruned {
+			if created[id] {
+				dropped[id] = true
+			}
+		}
+		kept := make([]int64, 0, len(affected))
+		for _, id := range affected {
+			if !dropped[id] {
+				kept = append(kept, id)
+			}
+		}
+		affected = kept
+	}
+
+	return e.addChange(&ChangeEntry{
+		Source:    name,
+		Sequence:  seq + 1,
+		Time:      time.Now(),
+		Relations: affected,
+	})
+}
+
+// Removes all queued versions of a relation
+func withoutRelation(rels []model.Relation, id int64) []model.Relation {
+	result := rels[:0]
+	for _, r := range rels {
+		if r.Id != id {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// Drops the cached geometries and coverages of all relations affected by
+// changes to the given nodes, ways and relations. Returns the affected
+// relations.
+func (e *Env) invalidateRelations(nodes, ways, relations []int64) ([]int64, error) {
+	index := e.newReverseIndex()
+	defer index.Close()
+
+	affectedWays := make(map[int64]bool)
+	for _, id := range ways {
+		affectedWays[id] = true
+	}
+	for _, id := range nodes {
+		nodeWays, err := index.nodeWays(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, way := range nodeWays {
+			affectedWays[way] = true
+		}
+	}
+
+	affected := make(map[int64]bool)
+	for _, id := range relations {
+		affected[id] = true
+	}
+	for id := range affectedWays {
+		wayRelations, err := index.wayRelations(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range wayRelations {
+			affected[rel] = true
+		}
+	}
+	ids := make([]int64, 0, len(affected))
+	for id := range affected {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	err := e.removeDerived(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		e.geosCache.Remove(fmt.Sprintf("%d", id))
+		for _, layer := range e.config.Layers {
+			e.topoCache.Remove(fmt.Sprintf("%s-%d", layer.ID, id))
+		}
+	}
+	e.removeTileCache()
+
+	return ids, nil
+}
+
+// Stores created before the reverse indexes (node -> ways, way -> relations)
+// existed don't have them. Build them once before replicating.
+func (e *Env) ensureReverseIndex() error {
+	indexed, err := e.getFlag("reverse-index")
+	if err != nil {
+		return err
+	}
+	if indexed {
+		return nil
+	}
+
+	e.log("store", "Building reverse indexes")
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+
+	it := e.db.NewIterator(ro)
+	defer it.Close()
+
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+
+	flush := func() error {
+		if wb.Count() == 0 {
+			return nil
+		}
+		err := e.db.Write(e.wo, wb)
+		wb.Clear()
+		return err
+	}
+
+	prefix := []byte("way/")
+	for it.Seek(prefix); it.ValidForPrefix(prefix) && e.ctx.Err() == nil; it.Next() {
+		data := it.Value()
+		way := model.Way{}
+		err := way.Unmarshal(data.Data())
+		data.Free()
+		if err != nil {
+			return err
+		}
+
+		indexWay(wb, way)
+		if wb.Count() > 100000 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	prefix = []byte("relation/")
+	for it.Seek(prefix); it.ValidForPrefix(prefix) && e.ctx.Err() == nil; it.Next() {
+		data := it.Value()
+		rel := model.Relation{}
+		err := rel.Unmarshal(data.Data())
+		data.Free()
 		if err != nil {
 			return err
 		}
+
+		indexRelation(wb, rel)
+		if wb.Count() > 100000 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if e.ctx.Err() != nil {
+		return e.ctx.Err()
+	}
+
+	err = flush()
+	if err != nil {
+		return err
 	}
 
-	return e.ctx.Err()
+	return e.setFlag("reverse-index", true)
 }
@@ -0,0 +1,511 @@
+package osmtopo
+
+import (
+	"encoding/binary"
+	"os"
+	"path"
+
+	"github.com/omniscale/imposm3/element"
+	"github.com/rubenv/osmtopo/osmtopo/model"
+	"github.com/rubenv/osmtopo/osmtopo/needidx"
+	"github.com/tecbot/gorocksdb"
+)
+
+// Import modes
+const (
+	// Parses the PBF file three times: relations, ways and nodes. Only
+	// needed data gets stored, at the expense of parsing time.
+	ImportMultiPass = "multi-pass"
+
+	// Parses the PBF file once, spooling all ways and nodes to temporary
+	// storage. Needed ways and nodes are picked from it afterwards.
+	ImportSinglePass = "single-pass"
+)
+
+const spoolBatchSize = 100000
+
+// Opens (or creates) the temporary storage of a single-pass import. It lives
+// next to the checkpoint, so a resumed import can use it.
+func (i *importer) openSpool() error {
+	folder := path.Join(i.checkpointFolder(), "spool")
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	opts := gorocksdb.NewDefaultOptions()
+	defer opts.Destroy()
+	opts.SetCreateIfMissing(true)
+	opts.SetMaxOpenFiles(256)
+
+	db, err := gorocksdb.OpenDb(opts, folder)
+	if err != nil {
+		return err
+	}
+	i.spool = db
+	return nil
+}
+
+func (i *importer) closeSpool() {
+	if i.spool != nil {
+		i.spool.Close()
+		i.spool = nil
+	}
+}
+
+// Single pass over the PBF file: relations get imported, ways and nodes are
+// spooled
+func (i *importer) runSinglePass(cp *importCheckpoint) error {
+	err := i.openSpool()
+	if err != nil {
+		return err
+	}
+	defer i.closeSpool()
+
+	if cp.Pass < passRelations {
+		relations := i.importRelations
+		if i.clip != nil {
+			relations = i.spoolRelations
+		}
+		err = i.runPass(cp, passRelations, i.spoolNodes, i.spoolWays, relations)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cp.Pass < passWays {
+		if i.clip != nil {
+			err = i.clipRelations()
+			if err != nil {
+				return err
+			}
+		}
+
+		i.setPhase(passNames[passWays], i.passTotal(passWays))
+		err = i.resolveWays()
+		if err != nil {
+			return err
+		}
+		err = i.saveCheckpoint(cp, passWays)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cp.Pass < passNodes {
+		i.setPhase(passNames[passNodes], i.passTotal(passNodes))
+		err = i.resolveNodes()
+		if err != nil {
+			return err
+		}
+		err = i.saveCheckpoint(cp, passNodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stores the spooled data of a clipped multi-pass import, which only holds
+// what the relations need
+func (i *importer) storeClipped() error {
+	err := i.clipRelations()
+	if err != nil {
+		return err
+	}
+
+	i.setPhase(passNames[passWays], i.passTotal(passWays))
+	err = i.resolveWays()
+	if err != nil {
+		return err
+	}
+
+	i.setPhase(passNames[passNodes], i.passTotal(passNodes))
+	return i.resolveNodes()
+}
+
+func (i *importer) spoolNodes() error {
+	return i.spoolNodesFiltered(false)
+}
+
+// Spools only the nodes marked as needed
+func (i *importer) spoolNeededNodes() error {
+	return i.spoolNodesFiltered(true)
+}
+
+func (i *importer) spoolNodesFiltered(needed bool) error {
+	nodeChan := i.nodes
+	coordChan := i.coords
+
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+
+	done := i.ctx.Done()
+	for nodeChan != nil || coordChan != nil {
+		var arr []element.Node
+		select {
+		case a, ok := <-coordChan:
+			if !ok {
+				coordChan = nil
+				continue
+			}
+			arr = a
+		case a, ok := <-nodeChan:
+			if !ok {
+				nodeChan = nil
+				continue
+			}
+			arr = a
+		case <-done:
+			return nil
+		}
+
+		for _, n := range arr {
+			if needed && !i.nodesNeeded.IsNeeded(n.Id) {
+				continue
+			}
+
+			node := NodeFromEl(n)
+			data, err := node.Marshal()
+			if err != nil {
+				return err
+			}
+			wb.Put(nodeKey(n.Id), data)
+		}
+
+		if wb.Count() > spoolBatchSize {
+			err := i.spool.Write(i.env.wo, wb)
+			if err != nil {
+				return err
+			}
+			wb.Clear()
+		}
+	}
+
+	return i.spool.Write(i.env.wo, wb)
+}
+
+func (i *importer) spoolWays() error {
+	return i.spoolWaysFiltered(false)
+}
+
+// Spools only the ways marked as needed, marking their nodes as needed
+func (i *importer) spoolNeededWays() error {
+	return i.spoolWaysFiltered(true)
+}
+
+func (i *importer) spoolWaysFiltered(needed bool) error {
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+
+	done := i.ctx.Done()
+	for {
+		var arr []element.Way
+		select {
+		case a, ok := <-i.ways:
+			if !ok {
+				return i.spool.Write(i.env.wo, wb)
+			}
+			arr = a
+		case <-done:
+			return nil
+		}
+
+		for _, w := range arr {
+			if needed {
+				if !i.waysNeeded.IsNeeded(w.Id) {
+					continue
+				}
+				for _, r := range w.Refs {
+					i.nodesNeeded.MarkNeeded(r)
+				}
+			}
+
+			way := WayFromEl(w)
+			data, err := way.Marshal()
+			if err != nil {
+				return err
+			}
+			wb.Put(wayKey(w.Id), data)
+		}
+
+		if wb.Count() > spoolBatchSize {
+			err := i.spool.Write(i.env.wo, wb)
+			if err != nil {
+				return err
+			}
+			wb.Clear()
+		}
+	}
+}
+
+// Spools the accepted relations of a clipped import, marking their ways as
+// needed. Whether they get stored is decided once their geometry is known.
+func (i *importer) spoolRelations() error {
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+
+	done := i.ctx.Done()
+	for {
+		var arr []element.Relation
+		select {
+		case a, ok := <-i.relations:
+			if !ok {
+				return i.spool.Write(i.env.wo, wb)
+			}
+			arr = a
+		case <-done:
+			return nil
+		}
+
+		for _, n := range arr {
+			if !i.env.config.AcceptRelation(n.Id, n.Tags) {
+				continue
+			}
+
+			for _, v := range n.Members {
+				if v.Type == element.WAY {
+					i.waysNeeded.MarkNeeded(v.Id)
+				}
+			}
+
+			rel := RelationFromEl(n, i.env.config.AcceptTag)
+			data, err := rel.Marshal()
+			if err != nil {
+				return err
+			}
+			wb.Put(relationKey(n.Id), data)
+		}
+
+		if wb.Count() > spoolBatchSize {
+			err := i.spool.Write(i.env.wo, wb)
+			if err != nil {
+				return err
+			}
+			wb.Clear()
+		}
+	}
+}
+
+// Stores the spooled relations that aren't entirely outside of the clip
+// area. Only their ways (and through those, their nodes) are needed.
+func (i *importer) clipRelations() error {
+	i.setPhase("clipping", 0)
+
+	src := &spoolSource{db: i.spool, ro: i.env.ro}
+	waysNeeded := needidx.New()
+	rels := []model.Relation{}
+	batchSize := 10000
+	removed := 0
+
+	err := i.iterSpool(relationKey(0)[:9], func(id int64, data []byte) error {
+		rel := model.Relation{}
+		err := rel.Unmarshal(data)
+		if err != nil {
+			return err
+		}
+
+		outside, err := outsideClipArea(i.clip, &rel, src)
+		if err != nil {
+			return err
+		}
+		if outside {
+			removed++
+			return nil
+		}
+
+		for _, m := range rel.Members {
+			if m.Type == int32(element.WAY) {
+				waysNeeded.MarkNeeded(m.Id)
+			}
+		}
+
+		rels = append(rels, rel)
+		if len(rels) > batchSize {
+			err := i.env.addNewRelations(rels)
+			if err != nil {
+				return err
+			}
+			i.relationCount.Add(int64(len(rels)))
+			rels = []model.Relation{}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(rels) > 0 {
+		err := i.env.addNewRelations(rels)
+		if err != nil {
+			return err
+		}
+		i.relationCount.Add(int64(len(rels)))
+	}
+
+	i.waysNeeded = waysNeeded
+	i.nodesNeeded = needidx.New()
+	i.log("Skipped %d relations outside of the clip area", removed)
+	return nil
+}
+
+// Stores the spooled ways that are needed by relations, marking their nodes
+// as needed
+func (i *importer) resolveWays() error {
+	ways := []model.Way{}
+	batchSize := 100000
+
+	err := i.iterSpool(wayKey(0)[:4], func(id int64, data []byte) error {
+		if !i.waysNeeded.IsNeeded(id) {
+			return nil
+		}
+
+		way := model.Way{}
+		err := way.Unmarshal(data)
+		if err != nil {
+			return err
+		}
+		for _, r := range way.Refs {
+			i.nodesNeeded.MarkNeeded(r)
+		}
+
+		ways = append(ways, way)
+		if len(ways) > batchSize {
+			err := i.env.addNewWays(ways)
+			if err != nil {
+				return err
+			}
+			i.wayCount.Add(int64(len(ways)))
+			ways = []model.Way{}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(ways) > 0 {
+		err := i.env.addNewWays(ways)
+		if err != nil {
+			return err
+		}
+		i.wayCount.Add(int64(len(ways)))
+	}
+	return nil
+}
+
+// Stores the spooled nodes that are needed by ways
+func (i *importer) resolveNodes() error {
+	nodes := []model.Node{}
+	batchSize := 2500000
+
+	err := i.iterSpool(nodeKey(0)[:5], func(id int64, data []byte) error {
+		if !i.nodesNeeded.IsNeeded(id) {
+			return nil
+		}
+
+		node := model.Node{}
+		err := node.Unmarshal(data)
+		if err != nil {
+			return err
+		}
+
+		nodes = append(nodes, node)
+		if len(nodes) > batchSize {
+			err := i.env.addNewNodes(nodes)
+			if err != nil {
+				return err
+			}
+			i.nodeCount.Add(int64(len(nodes)))
+			nodes = []model.Node{}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) > 0 {
+		err := i.env.addNewNodes(nodes)
+		if err != nil {
+			return err
+		}
+		i.nodeCount.Add(int64(len(nodes)))
+	}
+	return nil
+}
+
+// Reads ways and nodes from the spool, so relation geometries can be built
+// before anything gets stored
+type spoolSource struct {
+	db *gorocksdb.DB
+	ro *gorocksdb.ReadOptions
+}
+
+func (s *spoolSource) GetWay(id int64) (*model.Way, error) {
+	data, err := s.db.Get(s.ro, wayKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+
+	if data.Size() == 0 {
+		return nil, nil
+	}
+
+	way := &model.Way{}
+	err = way.Unmarshal(data.Data())
+	if err != nil {
+		return nil, err
+	}
+	return way, nil
+}
+
+func (s *spoolSource) GetNode(id int64) (*model.Node, error) {
+	data, err := s.db.Get(s.ro, nodeKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+
+	if data.Size() == 0 {
+		return nil, nil
+	}
+
+	node := &model.Node{}
+	err = node.Unmarshal(data.Data())
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Calls fn for all spooled entries with the given key prefix, in ID order
+func (i *importer) iterSpool(prefix []byte, fn func(id int64, data []byte) error) error {
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+
+	it := i.spool.NewIterator(ro)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if i.env.ctx.Err() != nil {
+			return i.env.ctx.Err()
+		}
+
+		key := it.Key()
+		k := key.Data()
+		id := int64(binary.BigEndian.Uint64(k[len(k)-8:]))
+		key.Free()
+
+		value := it.Value()
+		err := fn(id, value.Data())
+		value.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
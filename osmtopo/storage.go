@@ -12,23 +12,24 @@ import (
 	"github.com/rubenv/osmtopo/simplify"
 )
 
-func AcceptRelation(r model.Relation, blacklist []int64) bool {
-	admin, _ := r.GetTag("admin_level")
-	natural, _ := r.GetTag("natural")
-	ok := admin != "" || natural == "water"
-	if !ok {
-		return false
-	}
+type TagFilterFunc func(k, v string) bool
 
-	for _, id := range blacklist {
-		if r.Id == id {
-			return false
-		}
+// Checks whether a relation would be stored by the default configuration
+//
+// Deprecated: use Config.AcceptRelation, which also applies the configured
+// tag filters.
+func AcceptRelation(r model.Relation, blacklist []int64) bool {
+	tags := make(map[string]string, len(r.Tags))
+	for _, tag := range r.Tags {
+		tags[tag.Key] = tag.Value
 	}
 
-	return true
+	config := NewConfig()
+	config.Blacklist = blacklist
+	return config.AcceptRelation(r.Id, tags)
 }
 
+// Tags that are always stored: the admin level and names
 func AcceptTag(k, v string) bool {
 	if k == "admin_level" || k == "name" || strings.HasPrefix(k, "name:") {
 		return true
@@ -51,13 +52,14 @@ func WayFromEl(el element.Way) model.Way {
 	}
 }
 
-func RelationFromEl(n element.Relation) model.Relation {
+// Converts a relation, keeping only the tags accepted by the filter
+func RelationFromEl(n element.Relation, accept TagFilterFunc) model.Relation {
 	rel := model.Relation{
 		Id: n.Id,
 	}
 	tags := []*model.TagEntry{}
 	for k, v := range n.Tags {
-		if !AcceptTag(k, v) {
+		if !accept(k, v) {
 			continue
 		}
 		tags = append(tags, &model.TagEntry{
@@ -126,6 +128,17 @@ func ToGeometryCached(t string, r *model.Relation, e *Env) (*geojson.Geometry, e
 }
 
 func ToGeometry(r *model.Relation, e *Env) (*geos.Geometry, error) {
+	return relationGeometry(r, e)
+}
+
+// Where relation geometries get their ways and nodes from: the store, or the
+// spool of an import
+type elementSource interface {
+	GetWay(id int64) (*model.Way, error)
+	GetNode(id int64) (*model.Node, error)
+}
+
+func relationGeometry(r *model.Relation, e elementSource) (*geos.Geometry, error) {
 	outerParts := [][]int64{}
 	innerParts := [][]int64{}
 	for _, m := range r.GetMembers() {
@@ -171,7 +184,7 @@ func ToGeometry(r *model.Relation, e *Env) (*geos.Geometry, error) {
 	return MakePolygons(outerPolys, innerPolys)
 }
 
-func toGeom(env *Env, coords [][]int64) ([]*geos.Geometry, error) {
+func toGeom(env elementSource, coords [][]int64) ([]*geos.Geometry, error) {
 	linestrings := make([]*geos.Geometry, len(coords))
 	for i, v := range coords {
 		ls, err := expandPoly(env, v)
@@ -184,7 +197,7 @@ func toGeom(env *Env, coords [][]int64) ([]*geos.Geometry, error) {
 	return linestrings, nil
 }
 
-func expandPoly(env *Env, coords []int64) (*geos.Geometry, error) {
+func expandPoly(env elementSource, coords []int64) (*geos.Geometry, error) {
 	points := make([]geos.Coord, len(coords))
 	for i, c := range coords {
 		node, err := env.GetNode(c)
@@ -0,0 +1,430 @@
+package osmtopo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/rubenv/osmtopo/osmtopo/mvt"
+	"github.com/rubenv/topojson"
+)
+
+// Geometries are clipped slightly outside of the tile, which avoids seams
+// when rendering. In tile units.
+const tileBuffer = 64
+
+// Prefix of the tile features in the topology cache
+const tileCachePrefix = "tiles/"
+
+type tileFeature struct {
+	ID          uint64
+	Properties  map[string]interface{}
+	BoundingBox boundingBox
+	Geometry    *geos.Geometry
+	Prepared    *geos.PGeometry
+}
+
+// Zoom levels to render tiles for
+func (l Layer) ZoomRange() (int, int) {
+	max := l.MaxZoom
+	if max == 0 {
+		max = DefaultMaxZoom
+	}
+	return l.MinZoom, max
+}
+
+// Simplification tolerance at a zoom level: the size of a tile unit, but
+// never less than the simplification of the layer itself
+func zoomTolerance(layer Layer, z int) float64 {
+	tolerance := 360 / (float64(mvt.Extent) * math.Pow(2, float64(z)))
+	if layer.Simplify > 0 {
+		tolerance = math.Max(tolerance, math.Pow(10, float64(-layer.Simplify)))
+	}
+	return tolerance
+}
+
+// Simplifies the features of a layer for a zoom level. This is done on a
+// topology, so neighbouring features keep sharing their borders.
+func tileFeatures(layer Layer, fc *geojson.FeatureCollection, z int) ([]*tileFeature, error) {
+	topo := topojson.NewTopology(fc, &topojson.TopologyOptions{
+		Simplify:   zoomTolerance(layer, z),
+		IDProperty: "id",
+	})
+	simplified := topologyFeatures(topo)
+
+	result := make([]*tileFeature, 0, len(simplified.Features))
+	for _, f := range simplified.Features {
+		idStr, err := f.PropertyString("id")
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		geom, err := GeometryToGeos(f.Geometry)
+		if err != nil {
+			// Collapsed at this zoom level
+			continue
+		}
+
+		result = append(result, &tileFeature{
+			ID:          id,
+			Properties:  f.Properties,
+			BoundingBox: geometryBounds(f.Geometry),
+			Geometry:    geom,
+			Prepared:    geos.PrepareGeometry(geom),
+		})
+	}
+	return result, nil
+}
+
+func geometryBounds(g *geojson.Geometry) boundingBox {
+	bb := newBoundingBox()
+	switch g.Type {
+	case geojson.GeometryPolygon:
+		bb.boundMulti(g.Polygon)
+	case geojson.GeometryMultiPolygon:
+		for _, poly := range g.MultiPolygon {
+			bb.boundMulti(poly)
+		}
+	}
+	return bb
+}
+
+// Renders all tiles of a zoom level, in order. This goes one column of tiles
+// at a time, so only that column is held in memory.
+func renderTiles(layer Layer, features []*tileFeature, z int, fn func(tile mvt.Tile, data []byte) error) error {
+	ranges := make([]tileRange, 0, len(features))
+	minX := 1 << uint(z)
+	maxX := -1
+	for _, f := range features {
+		r := tileRange{Feature: f}
+		r.MinX, r.MinY, r.MaxX, r.MaxY = mvt.TileRange(z, f.BoundingBox)
+		if r.MinX > r.MaxX || r.MinY > r.MaxY {
+			continue
+		}
+		ranges = append(ranges, r)
+		if r.MinX < minX {
+			minX = r.MinX
+		}
+		if r.MaxX > maxX {
+			maxX = r.MaxX
+		}
+	}
+
+	for x := minX; x <= maxX; x++ {
+		column := make(map[mvt.Tile]*mvt.Layer)
+		for _, r := range ranges {
+			if x < r.MinX || x > r.MaxX {
+				continue
+			}
+
+			for y := r.MinY; y <= r.MaxY; y++ {
+				tile := mvt.Tile{Z: z, X: x, Y: y}
+				l, ok := column[tile]
+				if !ok {
+					l = mvt.NewLayer(layer.ID, tile)
+				}
+
+				err := addTileFeature(l, r.Feature, tile)
+				if err != nil {
+					return err
+				}
+
+				if !ok && l.Len() > 0 {
+					column[tile] = l
+				}
+			}
+		}
+
+		order := make(tileOrder, 0, len(column))
+		for tile := range column {
+			order = append(order, tile)
+		}
+		sort.Sort(order)
+
+		for _, tile := range order {
+			err := fn(tile, mvt.Encode(column[tile]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Tiles covered by a feature at a zoom level
+type tileRange struct {
+	Feature    *tileFeature
+	MinX, MinY int
+	MaxX, MaxY int
+}
+
+// Renders a single tile
+func renderTile(layer Layer, features []*tileFeature, tile mvt.Tile) ([]byte, error) {
+	l := mvt.NewLayer(layer.ID, tile)
+	bounds := boundingBox(tile.Bounds(tileBuffer, mvt.Extent))
+	for _, f := range features {
+		bb := f.BoundingBox
+		if bb[0] > bounds[2] || bb[2] < bounds[0] || bb[1] > bounds[3] || bb[3] < bounds[1] {
+			continue
+		}
+
+		err := addTileFeature(l, f, tile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mvt.Encode(l), nil
+}
+
+// Clips a feature to the tile and adds what remains to the layer
+func addTileFeature(l *mvt.Layer, f *tileFeature, tile mvt.Tile) error {
+	b := tile.Bounds(tileBuffer, mvt.Extent)
+	ring := [][]float64{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}, {b[0], b[1]}}
+	coords, err := toCoordSlices([][][]float64{ring})
+	if err != nil {
+		return err
+	}
+	rect, err := geos.NewPolygon(coords[0])
+	if err != nil {
+		return err
+	}
+
+	var polygons [][][][]float64
+
+	// Tiles within the feature are covered entirely
+	contains, err := f.Prepared.Contains(rect)
+	if err != nil {
+		return err
+	}
+	if contains {
+		polygons = [][][][]float64{{ring}}
+	} else {
+		intersects, err := f.Prepared.Intersects(rect)
+		if err != nil {
+			return err
+		}
+		if !intersects {
+			return nil
+		}
+
+		clipped, err := f.Geometry.Intersection(rect)
+		if err != nil {
+			return fmt.Errorf("Failed to clip %d to tile %s: %s", f.ID, tile, err)
+		}
+
+		polygons, err = polygonsFromGeos(clipped)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = l.AddPolygons(f.ID, f.Properties, polygons)
+	return err
+}
+
+// Collects the polygons in a geometry, ignoring anything else (clipping can
+// produce lines and points where a geometry touches the clip region)
+func polygonsFromGeos(geom *geos.Geometry) ([][][][]float64, error) {
+	empty, err := geom.IsEmpty()
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return nil, nil
+	}
+
+	t, err := geom.Type()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case geos.POLYGON:
+		rings, err := polyToRings(geom)
+		if err != nil {
+			return nil, err
+		}
+		return [][][][]float64{rings}, nil
+	case geos.MULTIPOLYGON, geos.GEOMETRYCOLLECTION:
+		n, err := geom.NGeometry()
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([][][][]float64, 0, n)
+		for i := 0; i < n; i++ {
+			g, err := geom.Geometry(i)
+			if err != nil {
+				return nil, err
+			}
+
+			polygons, err := polygonsFromGeos(g)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, polygons...)
+		}
+		return result, nil
+	default:
+		return nil, nil
+	}
+}
+
+type tileOrder []mvt.Tile
+
+func (t tileOrder) Len() int      { return len(t) }
+func (t tileOrder) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tileOrder) Less(i, j int) bool {
+	if t[i].X != t[j].X {
+		return t[i].X < t[j].X
+	}
+	return t[i].Y < t[j].Y
+}
+
+// Renders the tiles of all zoom levels of a layer, either as a {z}/{x}/{y}.pbf
+// tree or as an MBTiles file
+func writeTiles(filename string, layer Layer, format string, fc *geojson.FeatureCollection) error {
+	minZoom, maxZoom := layer.ZoomRange()
+
+	var write func(tile mvt.Tile, data []byte) error
+	var done func() error
+	var abort func() error
+	switch format {
+	case FormatMVT:
+		err := os.RemoveAll(filename)
+		if err != nil {
+			return err
+		}
+
+		write = func(tile mvt.Tile, data []byte) error {
+			folder := path.Join(filename, strconv.Itoa(tile.Z), strconv.Itoa(tile.X))
+			err := os.MkdirAll(folder, 0755)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path.Join(folder, fmt.Sprintf("%d.pbf", tile.Y)), data, 0644)
+		}
+		done = func() error { return nil }
+		abort = done
+	case FormatMBTiles:
+		m, err := mvt.CreateMBTiles(filename, tileMetadata(layer, fc))
+		if err != nil {
+			return err
+		}
+		write = m.WriteTile
+		done = m.Close
+		abort = m.Abort
+	default:
+		return fmt.Errorf("Unknown tile format: %s", format)
+	}
+
+	for z := minZoom; z <= maxZoom; z++ {
+		features, err := tileFeatures(layer, fc, z)
+		if err == nil {
+			err = renderTiles(layer, features, z, write)
+		}
+		if err != nil {
+			abort()
+			return err
+		}
+	}
+
+	return done()
+}
+
+func tileMetadata(layer Layer, fc *geojson.FeatureCollection) map[string]string {
+	minZoom, maxZoom := layer.ZoomRange()
+
+	bounds := newBoundingBox()
+	fields := make(map[string]string)
+	for _, f := range fc.Features {
+		bounds.extend(geometryBounds(f.Geometry))
+		for k := range f.Properties {
+			fields[k] = "String"
+		}
+	}
+	if bounds[0] > bounds[2] {
+		bounds = boundingBox{-180, -mvt.MaxLatitude, 180, mvt.MaxLatitude}
+	}
+
+	vectorLayers, _ := json.Marshal(map[string]interface{}{
+		"vector_layers": []map[string]interface{}{
+			{
+				"id":      layer.ID,
+				"fields":  fields,
+				"minzoom": minZoom,
+				"maxzoom": maxZoom,
+			},
+		},
+	})
+
+	return map[string]string{
+		"name":    layer.Name,
+		"type":    "overlay",
+		"minzoom": strconv.Itoa(minZoom),
+		"maxzoom": strconv.Itoa(maxZoom),
+		"bounds":  fmt.Sprintf("%f,%f,%f,%f", bounds[0], bounds[1], bounds[2], bounds[3]),
+		"json":    string(vectorLayers),
+	}
+}
+
+// Returns a tile of a layer, rendered on the fly
+func (e *Env) getTile(layer *Layer, tile mvt.Tile) ([]byte, error) {
+	key := fmt.Sprintf("%s%s/%d", tileCachePrefix, layer.ID, tile.Z)
+	t, ok := e.topoCache.Get(key)
+	if ok {
+		return renderTile(*layer, t.([]*tileFeature), tile)
+	}
+
+	fc, err := e.getLayerFeatures(layer)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := tileFeatures(*layer, fc, tile.Z)
+	if err != nil {
+		return nil, err
+	}
+	e.topoCache.Add(key, features)
+
+	return renderTile(*layer, features, tile)
+}
+
+// All features of a layer, as they get exported
+func (e *Env) getLayerFeatures(layer *Layer) (*geojson.FeatureCollection, error) {
+	key := fmt.Sprintf("%s%s", tileCachePrefix, layer.ID)
+	t, ok := e.topoCache.Get(key)
+	if ok {
+		return t.(*geojson.FeatureCollection), nil
+	}
+
+	topo, err := e.layerPipeline(*layer, true).Run()
+	if err != nil {
+		return nil, err
+	}
+
+	fc := topologyFeatures(topo)
+	e.topoCache.Add(key, fc)
+	return fc, nil
+}
+
+// Drops all cached tile features, needed when relations change
+func (e *Env) removeTileCache() {
+	for _, key := range e.topoCache.Keys() {
+		if k, ok := key.(string); ok && strings.HasPrefix(k, tileCachePrefix) {
+			e.topoCache.Remove(key)
+		}
+	}
+}
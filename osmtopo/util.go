@@ -323,6 +323,24 @@ func relationKey(id int64) []byte {
 	return buf
 }
 
+// Reverse index entry, marks that a way refers to a node
+func nodeWayKey(node, way int64) []byte {
+	buf := make([]byte, 25)
+	copy(buf, "nodeways/")
+	binary.BigEndian.PutUint64(buf[9:], uint64(node))
+	binary.BigEndian.PutUint64(buf[17:], uint64(way))
+	return buf
+}
+
+// Reverse index entry, marks that a relation has a way as a member
+func wayRelationKey(way, rel int64) []byte {
+	buf := make([]byte, 24)
+	copy(buf, "wayrels/")
+	binary.BigEndian.PutUint64(buf[8:], uint64(way))
+	binary.BigEndian.PutUint64(buf[16:], uint64(rel))
+	return buf
+}
+
 func missingKey(id string) []byte {
 	return []byte(fmt.Sprintf("missing/%s", id))
 }
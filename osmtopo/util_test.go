@@ -1,8 +1,11 @@
 package osmtopo
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/cheekybits/is"
 	"github.com/paulmach/go.geojson"
@@ -31,6 +34,22 @@ func TestRoundTripPolygon(t *testing.T) {
 	is.Equal(in, string(j2))
 }
 
+func TestReverseIndexKeys(t *testing.T) {
+	is := is.New(t)
+
+	// All ways of a node share a prefix, which is what getNodeWays scans
+	prefix := nodeWayKey(42, 0)[:17]
+	is.True(bytes.HasPrefix(nodeWayKey(42, 1), prefix))
+	is.True(bytes.HasPrefix(nodeWayKey(42, 123456789), prefix))
+	is.False(bytes.HasPrefix(nodeWayKey(43, 1), prefix))
+	is.Equal(binary.BigEndian.Uint64(nodeWayKey(42, 7)[17:]), uint64(7))
+
+	prefix = wayRelationKey(42, 0)[:16]
+	is.True(bytes.HasPrefix(wayRelationKey(42, 1), prefix))
+	is.False(bytes.HasPrefix(wayRelationKey(43, 1), prefix))
+	is.Equal(binary.BigEndian.Uint64(wayRelationKey(42, 7)[16:]), uint64(7))
+}
+
 /*
 func TestRoundTripPolygonObj(t *testing.T) {
 	is := is.New(t)
@@ -69,3 +88,16 @@ func TestRoundTripPolygonObj(t *testing.T) {
 	is.Equal(in, j2)
 }
 */
+
+func TestEstimateCompletion(t *testing.T) {
+	is := is.New(t)
+
+	is.Nil(estimateCompletion(time.Now(), 0, 100))
+	is.Nil(estimateCompletion(time.Now(), 10, 0))
+
+	// A quarter done in a minute: three more to go
+	eta := estimateCompletion(time.Now().Add(-time.Minute), 25, 100)
+	is.NotNil(eta)
+	remaining := eta.Sub(time.Now())
+	is.True(remaining > 175*time.Second && remaining < 185*time.Second)
+}
@@ -32,23 +32,56 @@ func (e *Env) updateWater() error {
 		return nil
 	}
 
+	return e.ImportWater("")
+}
+
+// Downloads the water polygons from the configured location into the given
+// file, without importing them.
+func (e *Env) DownloadWater(filename string) error {
+	e.done.Add(1)
+	defer e.done.Done()
+
+	if !strings.HasPrefix(e.config.Water, "http://") && !strings.HasPrefix(e.config.Water, "https://") {
+		return fmt.Errorf("Water location is not a URL: %s", e.config.Water)
+	}
+
+	folder, name := path.Split(filename)
+	if folder == "" {
+		folder = "."
+	}
+	return e.downloadWater(folder, name)
+}
+
+// Imports water polygons from a local zip file, replacing the current ones.
+// When no filename is given, the water polygons are fetched from the
+// configured location.
+func (e *Env) ImportWater(filename string) error {
+	e.done.Add(1)
+	defer e.done.Done()
+
 	tmp, err := ioutil.TempDir("", "water")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(tmp)
 
-	filename := path.Join(tmp, "water.zip")
-	if strings.HasPrefix(e.config.Water, "http://") || strings.HasPrefix(e.config.Water, "https://") {
-		err = e.downloadWater(tmp, "water.zip")
-		if err != nil {
-			return err
+	if filename == "" {
+		filename = path.Join(tmp, "water.zip")
+		if strings.HasPrefix(e.config.Water, "http://") || strings.HasPrefix(e.config.Water, "https://") {
+			err = e.downloadWater(tmp, "water.zip")
+			if err != nil {
+				return err
+			}
+		} else {
+			filename = e.config.Water
 		}
-	} else {
-		filename = e.config.Water
 	}
 
-	err = e.importWater(filename, tmp)
+	return e.refreshWater(filename, tmp)
+}
+
+func (e *Env) refreshWater(filename, folder string) error {
+	err := e.importWater(filename, folder)
 	if err != nil {
 		return err
 	}
@@ -57,6 +90,11 @@ func (e *Env) updateWater() error {
 	e.waterClipGeos = make(map[string][]*clipGeometry)
 	e.waterLock.Unlock()
 
+	err = e.removeClippedGeometries()
+	if err != nil {
+		return err
+	}
+
 	e.log("water", "Done")
 	return e.setTimestamp("water", time.Now())
 }